@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+Dates watering is blocked on, whatever the timepoints say:
+- config.Seasons, date ranges watering is allowed in, e.g. 04-01 to 10-31 to stop from November to March.
+Ranges are as 01-02 and apply every year, a range can wrap around the new year
+- config.Blackouts, dates or date ranges not to water on, e.g. for a party or a lawn treatment.
+As 2006-01-02 for a particular date, or 01-02 for the same date every year
+- the system being turned off, e.g. winterized, kept in the state file until it's turned back on, see command.go
+
+The scheduler checks these before firing a timepoint and reports blocked timepoints as skips with the reason.
+Runs already queued or soaking between cycles are checked again before each cycle, see RunManager.water
+*/
+
+// dates from From to To inclusive, To can be left out for a single date
+type DateRange struct {
+	From   string `json:"from"`   // 2006-01-02, or 01-02 for every year
+	To     string `json:"to"`     // same format as From
+	Reason string `json:"reason"` // logged with skips, for blackouts
+}
+
+// a date in a range, year is 0 for dates that apply every year
+type calendarDate struct {
+	year  int
+	month time.Month
+	day   int
+}
+
+func parseCalendarDate(s string) (calendarDate, error) {
+	t, err := time.Parse("2006-01-02", s)
+	if err == nil {
+		return calendarDate{t.Year(), t.Month(), t.Day()}, nil
+	}
+	t, err = time.Parse("01-02", s)
+	if err == nil {
+		return calendarDate{0, t.Month(), t.Day()}, nil
+	}
+	return calendarDate{}, fmt.Errorf("date %q must be like 2006-01-02, or 01-02 for every year", s)
+}
+
+// comparable value, month and day only when either date applies every year
+func (cd calendarDate) key(yearly bool) int {
+	k := int(cd.month)*100 + cd.day
+	if !yearly {
+		k += cd.year * 10000
+	}
+	return k
+}
+
+func (dr *DateRange) bounds() (calendarDate, calendarDate, error) {
+	from, err := parseCalendarDate(dr.From)
+	if err != nil {
+		return from, from, err
+	}
+	if dr.To == "" {
+		return from, from, nil
+	}
+	to, err := parseCalendarDate(dr.To)
+	if err != nil {
+		return from, to, err
+	}
+	return from, to, nil
+}
+
+func (dr *DateRange) Check() error {
+	from, to, err := dr.bounds()
+	if err != nil {
+		return err
+	}
+	if (from.year == 0) != (to.year == 0) {
+		return fmt.Errorf("date range %v to %v must be both every year or both particular dates", dr.From, dr.To)
+	}
+	if from.year != 0 && to.key(false) < from.key(false) {
+		return fmt.Errorf("date range %v to %v is backwards", dr.From, dr.To)
+	}
+	return nil
+}
+
+// whether the date of t, in t's location, is in the range
+func (dr *DateRange) Contains(t time.Time) bool {
+	from, to, err := dr.bounds()
+	if err != nil {
+		return false
+	}
+	yearly := from.year == 0
+	y, m, d := t.Date()
+	k := calendarDate{y, m, d}.key(yearly)
+	if yearly && to.key(true) < from.key(true) {
+		// wraps around the new year
+		return k >= from.key(true) || k <= to.key(true)
+	}
+	return k >= from.key(yearly) && k <= to.key(yearly)
+}
+
+// why watering is blocked at t, or "" if it isn't
+func (c *Config) Blocked(t time.Time) string {
+	if c.State != nil {
+		off, reason := c.State.IsOff()
+		if off {
+			if reason == "" {
+				return "system off"
+			}
+			return fmt.Sprintf("system off: %v", reason)
+		}
+	}
+	if len(c.Seasons) > 0 {
+		inSeason := false
+		for _, s := range c.Seasons {
+			if s.Contains(t) {
+				inSeason = true
+				break
+			}
+		}
+		if !inSeason {
+			return "out of season"
+		}
+	}
+	for _, b := range c.Blackouts {
+		if b.Contains(t) {
+			if b.Reason == "" {
+				return "blackout"
+			}
+			return fmt.Sprintf("blackout: %v", b.Reason)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDateRangeContains(t *testing.T) {
+	day := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 7, 0, 0, 0, time.Local)
+	}
+	cases := []struct {
+		dr       DateRange
+		t        time.Time
+		contains bool
+	}{
+		{DateRange{From: "04-01", To: "10-31"}, day(2024, 4, 1), true},
+		{DateRange{From: "04-01", To: "10-31"}, day(2025, 10, 31), true},
+		{DateRange{From: "04-01", To: "10-31"}, day(2024, 11, 1), false},
+		{DateRange{From: "04-01", To: "10-31"}, day(2024, 3, 31), false},
+		// wraps around the new year
+		{DateRange{From: "11-01", To: "03-31"}, day(2024, 12, 25), true},
+		{DateRange{From: "11-01", To: "03-31"}, day(2025, 2, 1), true},
+		{DateRange{From: "11-01", To: "03-31"}, day(2025, 6, 1), false},
+		{DateRange{From: "07-04"}, day(2031, 7, 4), true},
+		{DateRange{From: "07-04"}, day(2031, 7, 5), false},
+		{DateRange{From: "2024-06-14", To: "2024-06-16"}, day(2024, 6, 15), true},
+		{DateRange{From: "2024-06-14", To: "2024-06-16"}, day(2025, 6, 15), false},
+		{DateRange{From: "2024-12-30", To: "2025-01-02"}, day(2025, 1, 1), true},
+	}
+	for _, tc := range cases {
+		if tc.dr.Contains(tc.t) != tc.contains {
+			t.Errorf("expected %v to %v containing %v to be %v", tc.dr.From, tc.dr.To, tc.t.Format("2006-01-02"), tc.contains)
+		}
+	}
+
+	for _, dr := range []DateRange{
+		{From: "june 1"},
+		{From: "2024-06-16", To: "2024-06-14"},
+		{From: "2024-06-14", To: "06-16"},
+	} {
+		if dr.Check() == nil {
+			t.Errorf("expected error checking %v to %v", dr.From, dr.To)
+		}
+	}
+}
+
+func TestBlocked(t *testing.T) {
+	st, err := LoadState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatalf("could not load state: %v", err)
+	}
+	c := &Config{
+		Seasons:   []*DateRange{{From: "04-01", To: "10-31"}},
+		Blackouts: []*DateRange{{From: "2024-06-15", Reason: "party"}, {From: "07-04"}},
+		State:     st,
+	}
+	cases := []struct {
+		t      time.Time
+		reason string
+	}{
+		{time.Date(2024, 6, 14, 7, 0, 0, 0, time.Local), ""},
+		{time.Date(2024, 6, 15, 7, 0, 0, 0, time.Local), "blackout: party"},
+		{time.Date(2024, 7, 4, 7, 0, 0, 0, time.Local), "blackout"},
+		{time.Date(2024, 12, 1, 7, 0, 0, 0, time.Local), "out of season"},
+	}
+	for _, tc := range cases {
+		if reason := c.Blocked(tc.t); reason != tc.reason {
+			t.Errorf("expected %q on %v, got %q", tc.reason, tc.t.Format("2006-01-02"), reason)
+		}
+	}
+
+	err = st.SetOff("winterized")
+	if err != nil {
+		t.Fatalf("could not turn system off: %v", err)
+	}
+	if reason := c.Blocked(time.Date(2024, 6, 14, 7, 0, 0, 0, time.Local)); reason != "system off: winterized" {
+		t.Errorf("expected system off, got %q", reason)
+	}
+}
+
+func TestSchedulerSkipsBlocked(t *testing.T) {
+	s := testScheduler(t, time.UTC)
+	s.c.Blackouts = []*DateRange{{From: "06-18", Reason: "lawn treatment"}}
+	var fired int
+	var skipped []string
+	s.Fire = func(o Occurrence) { fired++ }
+	s.Skip = func(o Occurrence, reason string) { skipped = append(skipped, reason) }
+	for _, o := range s.Occurrences(time.Date(2024, 6, 17, 0, 0, 0, 0, time.UTC), time.Date(2024, 6, 19, 0, 0, 0, 0, time.UTC)) {
+		s.handle(o, s.Fire)
+	}
+	// monday's three fire, tuesday's two are skipped
+	if fired != 3 || len(skipped) != 2 || skipped[0] != "blackout: lawn treatment" {
+		t.Errorf("expected 3 fired and 2 skipped, got %v fired and skips %v", fired, skipped)
+	}
+}
+
+func TestOffStopsCycles(t *testing.T) {
+	c := testRunConfig(t, "1")
+	st, err := LoadState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatalf("could not load state: %v", err)
+	}
+	c.State = st
+	m := NewRunManager(c)
+	finished := make(chan *Run, 1)
+	m.OnFinish = func(r *Run) {
+		finished <- r
+	}
+
+	err = m.Enqueue(&Run{Valve: c.Valves[0], Duration: 3, Cycle: 1, Soak: 1})
+	if err != nil {
+		t.Fatalf("could not queue run: %v", err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	err = st.SetOff("winterized")
+	if err != nil {
+		t.Fatalf("could not turn off: %v", err)
+	}
+	m.Wait()
+
+	// turning off stops the run while it's soaking, its next cycle doesn't open the valve
+	r := <-finished
+	if r.Stopped != "system off: winterized" || len(r.Cycles) != 1 {
+		t.Errorf("expected run stopped by turning off after 1 cycle, got %q with cycles %+v", r.Stopped, r.Cycles)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Commands for changing state while the system is running, without editing config.json, e.g.
+	irrigation-system off winterized
+	irrigation-system on
+	irrigation-system rain-delay 48
+	irrigation-system rain-delay extend 24
+	irrigation-system rain-delay cancel
+	irrigation-system status
+They change the state file the running system reads before firing each timepoint, see state.go,
+and are recorded in the event log
+*/
+
+const commandUsage = "usage: irrigation-system [off [reason] | on | rain-delay [extend] hours | rain-delay cancel | status]"
+
+// run a command given on the command line, printing its result to out
+func RunCommand(c *Config, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf(commandUsage)
+	}
+	if c.State == nil {
+		return fmt.Errorf("commands need a state_file configured")
+	}
+	switch args[0] {
+	case "off":
+		reason := strings.Join(args[1:], " ")
+		err := c.State.SetOff(reason)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "system off, nothing will water until it's turned back on")
+		return LogSystem(c, fmt.Sprintf("System turned off || Reason: %v", reason), false)
+	case "on":
+		err := c.State.SetOn()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "system on")
+		return LogSystem(c, "System turned on", false)
+	case "rain-delay":
+		return rainDelayCommand(c, args[1:], out)
+	case "status":
+		sd := c.State.current()
+		if sd.Off {
+			fmt.Fprintf(out, "off since %v: %v\n", sd.OffSince.Format("2006-01-02 15:04"), sd.OffReason)
+		} else {
+			fmt.Fprintln(out, "on")
+		}
+		until := sd.RainDelayUntil
+		if until.After(time.Now()) {
+			fmt.Fprintf(out, "rain delay until %v\n", until.Format("2006-01-02 15:04"))
+		}
+		reason := c.Blocked(time.Now())
+		if reason != "" {
+			fmt.Fprintf(out, "not watering today, %v\n", reason)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown command %q, %v", args[0], commandUsage)
+}
+
+// set, extend or cancel the rain delay, see raindelay.go
+func rainDelayCommand(c *Config, args []string, out io.Writer) error {
+	if len(args) == 1 && args[0] == "cancel" {
+		err := c.State.SetRainDelay(time.Time{})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "rain delay cancelled")
+		return LogSystem(c, "Rain delay cancelled", false)
+	}
+
+	extend := len(args) == 2 && args[0] == "extend"
+	if extend {
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		return fmt.Errorf(commandUsage)
+	}
+	hours, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || hours <= 0 {
+		return fmt.Errorf("rain delay needs a number of hours greater than 0, got %q", args[0])
+	}
+	d := time.Duration(hours * float64(time.Hour))
+
+	now := time.Now()
+	until := now.Add(d)
+	if extend {
+		until, err = c.State.ExtendRainDelay(d, now)
+	} else {
+		err = c.State.SetRainDelay(until)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "rain delay until %v\n", until.Format("2006-01-02 15:04"))
+	return LogSystem(c, fmt.Sprintf("Rain delay set || Until: %v", until.Format("2006-01-02 15:04")), false)
+}
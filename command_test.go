@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandOffOn(t *testing.T) {
+	dir := t.TempDir()
+	c := &Config{EventLogFile: filepath.Join(dir, "events.log"), StateFile: filepath.Join(dir, "state.json")}
+	err := c.InitState()
+	if err != nil {
+		t.Fatalf("could not load state: %v", err)
+	}
+	// the running system has its own copy of the state
+	running, err := LoadState(c.StateFile)
+	if err != nil {
+		t.Fatalf("could not load state: %v", err)
+	}
+
+	var out bytes.Buffer
+	err = RunCommand(c, []string{"off", "winterized"}, &out)
+	if err != nil {
+		t.Fatalf("could not run off command: %v", err)
+	}
+	// saving the scheduler's progress mustn't turn it back on
+	err = running.SetEvaluated(time.Now())
+	if err != nil {
+		t.Fatalf("could not save state: %v", err)
+	}
+	off, reason := running.IsOff()
+	if !off || reason != "winterized" {
+		t.Errorf("expected running system to see it's off, got %v %q", off, reason)
+	}
+
+	out.Reset()
+	err = RunCommand(c, []string{"status"}, &out)
+	if err != nil || !strings.Contains(out.String(), "winterized") {
+		t.Errorf("expected status to show system off, got %q %v", out.String(), err)
+	}
+
+	err = RunCommand(c, []string{"on"}, &out)
+	if err != nil {
+		t.Fatalf("could not run on command: %v", err)
+	}
+	if off, _ := running.IsOff(); off {
+		t.Error("expected system back on")
+	}
+	b, _ := os.ReadFile(c.EventLogFile)
+	if !strings.Contains(string(b), "System turned off || Reason: winterized") || !strings.Contains(string(b), "System turned on") {
+		t.Errorf("expected off and on in event log, got %q", b)
+	}
+
+	if RunCommand(c, []string{"sideways"}, &out) == nil {
+		t.Error("expected error for unknown command")
+	}
+}
@@ -6,6 +6,9 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/lib/pq"
@@ -34,9 +37,91 @@ type Config struct {
 	RainThreshold      float32  `json:"rain_threshold"`       // sum of precipitation (in mm) in the lookback and lookahead period to use as threshold for skipping a watering
 	HotThreshold       float32  `json:"hot_threshold"`        // temp in F that is considered hot, used to determine whether to do a secondary water
 	CheckOnlineUrl     string   `json:"check_online_url"`     // url to use to check if device is internet connected
+	Driver             string   `json:"driver"`               // default valve driver, "rpio" (default), "gpiod", "mcp23017", "pcf8574", "modbus", "http" or "fake" for running without gpio hardware
+
+	// run queue, used when timepoints on several valves collide
+	MaxConcurrentValves int `json:"max_concurrent_valves"` // how many valves may be open at once, defaults to 1
+	InterZoneDelay      int `json:"inter_zone_delay"`      // seconds to wait after a valve closes before opening the next queued one
+
+	Modbus *ModbusConfig `json:"modbus"` // connection to a modbus relay board, for valves using the modbus driver, see modbus.go
+
+	Master *MasterValve `json:"master_valve"` // optional master valve or pump relay, opened around every zone run, see master.go
+
+	// runtime safety limits, see limits.go, 0 means no limit
+	MaxRunDuration  int `json:"max_run_duration"`  // longest single run in seconds, valves can override
+	MaxDailyRuntime int `json:"max_daily_runtime"` // total seconds all valves together may run per day
+
+	FlowMeter   *FlowMeter   `json:"flow_meter"`   // optional mainline flow meter, see flow.go
+	MoistureADC *MoistureADC `json:"moisture_adc"` // optional adc for valves' soil moisture probes, see moisture.go
+	RainSensor  *RainSensor  `json:"rain_sensor"`  // optional rain switch on a gpio input, see rain.go
+	RainGauge   *RainGauge   `json:"rain_gauge"`   // optional tipping-bucket rain gauge for past precipitation, see gauge.go
+
+	Seasonal *SeasonalAdjust `json:"seasonal_adjust"` // optional percentage through the year to scale all durations by, see seasonal.go
+
+	// dates watering is blocked on, see calendar.go
+	Seasons   []*DateRange `json:"seasons"`   // ranges of 01-02 dates watering is allowed in, all year if empty
+	Blackouts []*DateRange `json:"blackouts"` // dates not to water on, as 2006-01-02, or 01-02 for every year
+
+	// location for sunrise and sunset timepoints, see solar.go
+	Latitude   float64 `json:"latitude"`    // degrees north
+	Longitude  float64 `json:"longitude"`   // degrees east, negative in the americas
+	SolarCheck int     `json:"solar_check"` // minutes the computed sun times may differ from the forecast's before an error is logged, 0 to not check
+
+	// state kept across restarts, see state.go
+	StateFile   string `json:"state_file"`   // file to keep state in, needed to catch up on timepoints missed while not running and to keep daily runtime across restarts
+	MissedGrace int    `json:"missed_grace"` // minutes back to look for missed timepoints on startup, defaults to 60
+
+	// runtime state, built after the config file is read
+	Drivers map[string]ValveDriver `json:"-"` // drivers in use, keyed by name, see InitDrivers
+	State   *State                 `json:"-"` // loaded from StateFile
+
+	// guards UseDBLog, UsePushover and UseWeather, which OnlineCheck switches while
+	// runs and watchers are logging, read them through DBLogOn, PushoverOn and WeatherOn
+	flagsMu sync.RWMutex
 }
 
+// read config and set up everything it describes, including hardware
 func ReadConfig(path string) (*Config, error) {
+	c, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.InitDrivers()
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.InitFlowMeter()
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.InitMoisture()
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.InitRainSensor()
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.InitRainGauge()
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.InitState()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// read config from file without touching hardware, e.g. for commands, see command.go
+func LoadConfig(path string) (*Config, error) {
 	f, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("could not read config file contents: %v", err)
@@ -58,10 +143,57 @@ func ReadConfig(path string) (*Config, error) {
 		}
 		c.LogDB = db
 	}
-
 	return c, nil
 }
 
+// create the valve drivers named in config and attach them to valves,
+// valves without their own driver field use the config level one
+func (c *Config) InitDrivers() error {
+	if c.Drivers == nil {
+		c.Drivers = make(map[string]ValveDriver)
+	}
+	for _, v := range c.Valves {
+		d, err := c.GetDriver(c.ValveDriver(v))
+		if err != nil {
+			return fmt.Errorf("could not create driver for valve %v: %v", v.ID, err)
+		}
+		v.Device = d
+	}
+	if c.Master != nil {
+		d, err := c.GetDriver(c.ValveDriver(&c.Master.Valve))
+		if err != nil {
+			return fmt.Errorf("could not create driver for master valve: %v", err)
+		}
+		c.Master.Device = d
+	}
+	return nil
+}
+
+// name of the driver a valve uses, its own driver field or else the config level one
+func (c *Config) ValveDriver(v *Valve) string {
+	if v.Driver != "" {
+		return v.Driver
+	}
+	return c.Driver
+}
+
+// get a shared driver by name, creating it on first use
+func (c *Config) GetDriver(name string) (ValveDriver, error) {
+	if c.Drivers == nil {
+		c.Drivers = make(map[string]ValveDriver)
+	}
+	d, ok := c.Drivers[name]
+	if ok {
+		return d, nil
+	}
+	d, err := NewValveDriver(c, name)
+	if err != nil {
+		return nil, err
+	}
+	c.Drivers[name] = d
+	return d, nil
+}
+
 // Check config to make sure that configuration dependencies are met
 // E.g. if UseWeather is set to true but WeatherAPIKey is blank, return an error
 func (c *Config) CheckConfig() error {
@@ -75,6 +207,118 @@ func (c *Config) CheckConfig() error {
 		return fmt.Errorf(`please provide full config details for log db (log_db_uri, event_table, error_table) to use log db, \
 					otherwise set use_log_db to false`)
 	}
+	for _, v := range c.Valves {
+		driver := c.ValveDriver(v)
+		if driver == "gpiod" && v.Chip == "" {
+			return fmt.Errorf("valve %v uses the gpiod driver but has no chip configured", v.ID)
+		}
+		if (driver == "mcp23017" || driver == "pcf8574") && (v.Address < 0x03 || v.Address > 0x77) {
+			return fmt.Errorf("valve %v uses the %v driver but has no valid i2c address configured", v.ID, driver)
+		}
+		if driver == "http" {
+			rr := v.Remote
+			if rr == nil || rr.OnURL == "" || rr.OffURL == "" {
+				return fmt.Errorf("valve %v uses the http driver but has no remote on_url and off_url configured", v.ID)
+			}
+			if rr.AutoOff <= 0 || !(strings.Contains(rr.OnURL, "{seconds}") || strings.Contains(rr.OnURL, "{ms}")) {
+				return fmt.Errorf("remote valve %v needs an auto_off, passed to the relay with {seconds} or {ms} in on_url", v.ID)
+			}
+			if rr.StatusURL != "" && rr.StatusOn == "" {
+				return fmt.Errorf("remote valve %v has a status_url but no status_on", v.ID)
+			}
+		}
+		for _, tp := range v.Timepoints {
+			if tp.VolumeL > 0 && (c.FlowMeter == nil || tp.Duration <= 0) {
+				return fmt.Errorf("timepoints on valve %v with volume_l need a flow_meter, and a duration to use as timeout", v.ID)
+			}
+			_, err := tp.Schedule()
+			if err != nil {
+				return fmt.Errorf("timepoint on valve %v: %v", v.ID, err)
+			}
+			if tp.EveryDays < 0 {
+				return fmt.Errorf("timepoints on valve %v can't have a negative every_days", v.ID)
+			}
+			if tp.EveryDays > 0 {
+				_, err := time.Parse("2006-01-02", tp.Anchor)
+				if err != nil {
+					return fmt.Errorf("timepoints on valve %v with every_days need an anchor date like 2006-01-02", v.ID)
+				}
+			}
+			if !slices.Contains([]string{"", "odd", "even"}, tp.DateParity) {
+				return fmt.Errorf("timepoints on valve %v must have date_parity set to odd or even", v.ID)
+			}
+			for _, d := range tp.MonthDays {
+				if d < 1 || d > 31 {
+					return fmt.Errorf("timepoints on valve %v have month day %v out of range 1-31", v.ID, d)
+				}
+			}
+			if !slices.Contains([]string{"", "sunrise", "sunset"}, tp.Solar) {
+				return fmt.Errorf("timepoints on valve %v must have solar set to sunrise or sunset", v.ID)
+			}
+			if tp.Solar != "" && (tp.Cron != "" || (c.Latitude == 0 && c.Longitude == 0)) {
+				return fmt.Errorf("solar timepoints on valve %v need latitude and longitude configured, and can't use cron", v.ID)
+			}
+			if !slices.Contains([]string{"", "skip", "run", "notify"}, tp.Missed) {
+				return fmt.Errorf("timepoints on valve %v must have missed set to skip, run or notify", v.ID)
+			}
+			cycle, soak := v.CycleSoak(tp)
+			if cycle < 0 || soak < 0 {
+				return fmt.Errorf("valve %v has a negative cycle_seconds or soak_seconds", v.ID)
+			}
+		}
+		if !slices.Contains([]string{"", "active_high", "active_low"}, v.Polarity) {
+			return fmt.Errorf("valve %v polarity must be active_high or active_low", v.ID)
+		}
+		if v.Latching && v.OpenPin == v.ClosePin {
+			return fmt.Errorf("latching valve %v needs different open_pin and close_pin", v.ID)
+		}
+		if v.Moisture != nil && c.MoistureADC == nil {
+			return fmt.Errorf("valve %v has a moisture probe but no moisture_adc is configured", v.ID)
+		}
+		if v.Seasonal != nil {
+			err := v.Seasonal.Check()
+			if err != nil {
+				return fmt.Errorf("valve %v: %v", v.ID, err)
+			}
+		}
+	}
+	if c.Seasonal != nil {
+		err := c.Seasonal.Check()
+		if err != nil {
+			return err
+		}
+	}
+	for _, s := range c.Seasons {
+		err := s.Check()
+		if err != nil {
+			return fmt.Errorf("season: %v", err)
+		}
+		from, _, _ := s.bounds()
+		if from.year != 0 {
+			return fmt.Errorf("season %v to %v must use 01-02 dates, seasons apply every year", s.From, s.To)
+		}
+	}
+	for _, b := range c.Blackouts {
+		err := b.Check()
+		if err != nil {
+			return fmt.Errorf("blackout: %v", err)
+		}
+	}
+	if c.Modbus != nil && c.Modbus.Address == "" && c.Modbus.Device == "" {
+		return fmt.Errorf("modbus needs an address for tcp or a device for rtu")
+	}
+	if c.FlowMeter != nil && c.FlowMeter.PulsesPerLitre <= 0 {
+		return fmt.Errorf("flow_meter needs pulses_per_litre greater than 0")
+	}
+	if c.FlowMeter != nil && c.FlowMeter.ShutoffMaster && c.Master == nil {
+		return fmt.Errorf("flow_meter shutoff_master needs a master_valve")
+	}
+	if c.RainGauge != nil && (c.RainGauge.MMPerTip <= 0 || c.RainGauge.StoreFile == "") {
+		return fmt.Errorf("rain_gauge needs mm_per_tip greater than 0 and a store_file")
+	}
+	if c.RainGauge != nil && !slices.Contains([]string{"", "replace", "blend", "max"}, c.RainGauge.Mode) {
+		return fmt.Errorf("rain_gauge mode must be replace, blend or max")
+	}
 
 	return nil
 }
@@ -86,6 +330,8 @@ func (c *Config) OnlineCheck() error {
 	}
 
 	_, err := client.Get(c.CheckOnlineUrl)
+	c.flagsMu.Lock()
+	defer c.flagsMu.Unlock()
 	if err != nil {
 		c.UseDBLog = false
 		c.UsePushover = false
@@ -103,3 +349,24 @@ func (c *Config) OnlineCheck() error {
 	}
 	return err
 }
+
+// whether events and errors are logged to the db, as last set by OnlineCheck
+func (c *Config) DBLogOn() bool {
+	c.flagsMu.RLock()
+	defer c.flagsMu.RUnlock()
+	return c.UseDBLog
+}
+
+// whether push notifications are sent, as last set by OnlineCheck
+func (c *Config) PushoverOn() bool {
+	c.flagsMu.RLock()
+	defer c.flagsMu.RUnlock()
+	return c.UsePushover
+}
+
+// whether the weather api is used, as last set by OnlineCheck
+func (c *Config) WeatherOn() bool {
+	c.flagsMu.RLock()
+	defer c.flagsMu.RUnlock()
+	return c.UseWeather
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestOnlineCheckWhileLogging(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	c := &Config{EventLogFile: filepath.Join(t.TempDir(), "events.log"), CheckOnlineUrl: srv.URL}
+
+	// runs log from their own goroutines while the scheduler checks the connection, run with -race
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			_ = LogError(c, errors.New("test error"))
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		err := c.OnlineCheck()
+		if err != nil {
+			t.Fatalf("could not check online: %v", err)
+		}
+	}
+	wg.Wait()
+
+	srv.Close()
+	_ = c.OnlineCheck()
+	if c.DBLogOn() || c.PushoverOn() || c.WeatherOn() {
+		t.Error("expected everything online to be off when offline")
+	}
+}
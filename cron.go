@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Standard 5-field cron expressions for timepoints: minute hour day-of-month month day-of-week.
+// Fields take *, single values, ranges (10-16), steps (*/20, 10-16/2) and comma separated lists of these.
+// Months and days of week can also be given by name (JAN, MON), and Sunday is 0 or 7.
+// As in vixie cron, when both day-of-month and day-of-week are restricted a day matching either fires,
+// e.g. "*/20 10-15 * * 1-5" is every 20 minutes from 10:00 to 15:40 on weekdays
+
+var cronMonths = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var cronDays = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// parsed cron expression, each field a bitset with bit n set when n matches
+type CronSchedule struct {
+	minute  uint64
+	hour    uint64
+	dom     uint64
+	month   uint64
+	dow     uint64
+	domStar bool // day-of-month field starts with *
+	dowStar bool // day-of-week field starts with *
+}
+
+func ParseCron(expr string) (*CronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields", expr)
+	}
+	var cs CronSchedule
+	var err error
+	parsers := []struct {
+		set   *uint64
+		min   int
+		max   int
+		names map[string]int
+		name  string
+	}{
+		{&cs.minute, 0, 59, nil, "minute"},
+		{&cs.hour, 0, 23, nil, "hour"},
+		{&cs.dom, 1, 31, nil, "day of month"},
+		{&cs.month, 1, 12, cronMonths, "month"},
+		{&cs.dow, 0, 7, cronDays, "day of week"},
+	}
+	for i, p := range parsers {
+		*p.set, err = parseCronField(fields[i], p.min, p.max, p.names)
+		if err != nil {
+			return nil, fmt.Errorf("bad %v in cron expression %q: %v", p.name, expr, err)
+		}
+	}
+	// sunday can be 7
+	if cs.dow&(1<<7) != 0 {
+		cs.dow = cs.dow&^(1<<7) | 1
+	}
+	cs.domStar = strings.HasPrefix(fields[2], "*")
+	cs.dowStar = strings.HasPrefix(fields[4], "*")
+	return &cs, nil
+}
+
+func parseCronValue(s string, min int, max int, names map[string]int) (int, error) {
+	n, ok := names[strings.ToLower(s)]
+	if !ok {
+		var err error
+		n, err = strconv.Atoi(s)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a number", s)
+		}
+	}
+	if n < min || n > max {
+		return 0, fmt.Errorf("%v is out of range %v-%v", n, min, max)
+	}
+	return n, nil
+}
+
+func parseCronField(field string, min int, max int, names map[string]int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepStr)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("bad step %q", stepStr)
+			}
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			loStr, hiStr, isRange := strings.Cut(rng, "-")
+			var err error
+			lo, err = parseCronValue(loStr, min, max, names)
+			if err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				hi, err = parseCronValue(hiStr, min, max, names)
+				if err != nil {
+					return 0, err
+				}
+				if hi < lo {
+					return 0, fmt.Errorf("range %q is backwards", rng)
+				}
+			} else if hasStep {
+				// a single value with a step runs to the end of the field
+				hi = max
+			}
+		}
+		for n := lo; n <= hi; n += step {
+			set |= 1 << n
+		}
+	}
+	return set, nil
+}
+
+// whether the schedule fires on the date of t, in t's location
+func (cs *CronSchedule) OnDay(t time.Time) bool {
+	if cs.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	dom := cs.dom&(1<<t.Day()) != 0
+	dow := cs.dow&(1<<int(t.Weekday())) != 0
+	if cs.domStar || cs.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// times the schedule fires on the date of day, in loc, oldest first
+func (cs *CronSchedule) Times(day time.Time, loc *time.Location) []time.Time {
+	if !cs.OnDay(day) {
+		return nil
+	}
+	y, m, d := day.Date()
+	times := make([]time.Time, 0, bits.OnesCount64(cs.hour)*bits.OnesCount64(cs.minute))
+	for h := 0; h < 24; h++ {
+		if cs.hour&(1<<h) == 0 {
+			continue
+		}
+		for min := 0; min < 60; min++ {
+			if cs.minute&(1<<min) == 0 {
+				continue
+			}
+			t := time.Date(y, m, d, h, min, 0, 0, loc)
+			// times skipped by DST move into the next hour, don't fire them twice
+			if len(times) > 0 && !t.After(times[len(times)-1]) {
+				continue
+			}
+			times = append(times, t)
+		}
+	}
+	return times
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, expr := range []string{
+		"* * * * *",
+		"*/20 10-15 * * 1-5",
+		"0,30 6 1,15 * *",
+		"5 4 * jan-mar,oct SUN",
+		"0 22 * * 7",
+		"10-40/10 0-23/6 */2 * *",
+	} {
+		_, err := ParseCron(expr)
+		if err != nil {
+			t.Errorf("could not parse %q: %v", expr, err)
+		}
+	}
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"10-5 * * * *",
+		"a * * * *",
+		"* * * * mon-",
+	} {
+		_, err := ParseCron(expr)
+		if err == nil {
+			t.Errorf("expected error parsing %q", expr)
+		}
+	}
+}
+
+func TestCronTimepoint(t *testing.T) {
+	tp := &WaterTimepoint{Cron: "*/20 10-15 * * 1-5"}
+	times := tp.Times(&Config{}, time.Date(2024, 6, 17, 0, 0, 0, 0, time.UTC), time.UTC)
+	if len(times) != 18 || times[0].Hour() != 10 || times[17].Minute() != 40 {
+		t.Errorf("expected 18 times from 10:00 to 15:40, got %v", times)
+	}
+
+	// day rules still apply to cron timepoints
+	odd := &WaterTimepoint{Cron: "*/20 10-15 * * 1-5", DateParity: "odd"}
+	if n := len(odd.Times(&Config{}, time.Date(2024, 6, 18, 0, 0, 0, 0, time.UTC), time.UTC)); n != 0 {
+		t.Errorf("expected no times on an even date, got %v", n)
+	}
+	if n := len(odd.Times(&Config{}, time.Date(2024, 6, 17, 0, 0, 0, 0, time.UTC), time.UTC)); n != 18 {
+		t.Errorf("expected 18 times on an odd date, got %v", n)
+	}
+
+	c := &Config{EventLogFile: "events.log", ErrorLogFile: "errors.log", Valves: []*Valve{
+		&Valve{ID: "1", Timepoints: []*WaterTimepoint{&WaterTimepoint{Cron: "* * * *"}}},
+	}}
+	if c.CheckConfig() == nil {
+		t.Error("expected config check to reject a bad cron expression")
+	}
+}
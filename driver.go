@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/stianeikeland/go-rpio/v4"
+)
+
+// Hardware abstraction for opening and closing valves.
+// A single driver instance is shared by every valve that uses it,
+// so implementations must be safe for concurrent use
+type ValveDriver interface {
+	Open(v *Valve) error           // energise the valve
+	Close(v *Valve) error          // de-energise the valve
+	IsOpen(v *Valve) (bool, error) // report whether the valve is currently open
+}
+
+// default length of a latching solenoid's open or close pulse
+const defaultPulseWidth = 50 * time.Millisecond
+
+// whether the valve's relay or solenoid driver switches on when its output is low.
+// drivers set an output's level before making it an output, so an active low relay doesn't click on
+func (v *Valve) ActiveLow() bool {
+	return v.Polarity == "active_low"
+}
+
+func (v *Valve) pulseWidth() time.Duration {
+	if v.PulseWidth <= 0 {
+		return defaultPulseWidth
+	}
+	return time.Duration(v.PulseWidth) * time.Millisecond
+}
+
+// send a latching valve's open or close pulse, set drives one of its outputs active or idle.
+// the pulsed output is always returned to idle, even if driving it active failed
+func (v *Valve) pulse(open bool, set func(out int, active bool) error) error {
+	out, other := v.ClosePin, v.OpenPin
+	if open {
+		out, other = v.OpenPin, v.ClosePin
+	}
+	// never drive both sides of the h-bridge at once
+	err := set(other, false)
+	if err != nil {
+		return err
+	}
+	err = set(out, true)
+	if err == nil {
+		time.Sleep(v.pulseWidth())
+	}
+	return errors.Join(err, set(out, false))
+}
+
+// last pulsed state of latching valves, keyed by valve id, kept by drivers as latching valves can't be read back
+type latchState map[string]bool
+
+// open or close a valve with set, by driving out for a plain valve or by pulsing a latching one,
+// recording what a latching valve was pulsed to. drivers call this holding their lock,
+// so a shared solenoid supply only powers one pulse at a time
+func (ls latchState) drive(v *Valve, out int, open bool, set func(out int, active bool) error) error {
+	if !v.Latching {
+		return set(out, open)
+	}
+	err := v.pulse(open, set)
+	if err != nil {
+		return err
+	}
+	ls[v.ID] = open
+	return nil
+}
+
+// build a valve driver by name, as used in the driver config field
+func NewValveDriver(c *Config, name string) (ValveDriver, error) {
+	switch name {
+	case "", "rpio":
+		return &RpioDriver{}, nil
+	case "gpiod":
+		return NewGpiodDriver(), nil
+	case "mcp23017", "pcf8574":
+		return NewExpanderDriver(name), nil
+	case "modbus":
+		return NewModbusDriver(c.Modbus)
+	case "http":
+		return NewHTTPDriver(c), nil
+	case "fake":
+		return NewFakeDriver(), nil
+	}
+	return nil, fmt.Errorf("unknown valve driver %q", name)
+}
+
+// drives valves directly through /dev/gpiomem on a Raspberry Pi, using Valve.Pin,
+// or Valve.OpenPin and Valve.ClosePin for latching valves
+type RpioDriver struct {
+	mu      sync.Mutex
+	opened  bool
+	latched latchState
+}
+
+// map gpio memory on first use, it stays mapped for the life of the process
+func (d *RpioDriver) init() error {
+	if d.opened {
+		return nil
+	}
+	err := rpio.Open()
+	if err != nil {
+		return fmt.Errorf("could not open gpio memory range: %v", err)
+	}
+	d.latched = make(latchState)
+	d.opened = true
+	return nil
+}
+
+// drive a pin to the valve's active or idle level, caller must hold the lock
+func (d *RpioDriver) set(v *Valve, pin int, active bool) {
+	p := rpio.Pin(pin)
+	// level before direction, see Valve.ActiveLow
+	if active != v.ActiveLow() {
+		p.High()
+	} else {
+		p.Low()
+	}
+	p.Output()
+}
+
+func (d *RpioDriver) drive(v *Valve, open bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.init()
+	if err != nil {
+		return err
+	}
+	return d.latched.drive(v, v.Pin, open, func(pin int, active bool) error {
+		d.set(v, pin, active)
+		return nil
+	})
+}
+
+func (d *RpioDriver) Open(v *Valve) error {
+	return d.drive(v, true)
+}
+
+func (d *RpioDriver) Close(v *Valve) error {
+	return d.drive(v, false)
+}
+
+// reads the pin level back, see latchState for latching valves
+func (d *RpioDriver) IsOpen(v *Valve) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.init()
+	if err != nil {
+		return false, err
+	}
+	if v.Latching {
+		return d.latched[v.ID], nil
+	}
+	return (rpio.Pin(v.Pin).Read() == rpio.High) != v.ActiveLow(), nil
+}
+
+// single open or close of a valve, as recorded by FakeDriver
+type ValveTransition struct {
+	ValveID string
+	Open    bool
+	Time    time.Time
+}
+
+// in-memory valve driver that records every transition, for tests and for running off-Pi
+type FakeDriver struct {
+	mu          sync.Mutex
+	open        map[string]bool
+	transitions []ValveTransition
+}
+
+func NewFakeDriver() *FakeDriver {
+	return &FakeDriver{
+		open: make(map[string]bool),
+	}
+}
+
+func (d *FakeDriver) set(v *Valve, open bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.open[v.ID] = open
+	d.transitions = append(d.transitions, ValveTransition{
+		ValveID: v.ID,
+		Open:    open,
+		Time:    time.Now(),
+	})
+}
+
+func (d *FakeDriver) Open(v *Valve) error {
+	d.set(v, true)
+	return nil
+}
+
+func (d *FakeDriver) Close(v *Valve) error {
+	d.set(v, false)
+	return nil
+}
+
+func (d *FakeDriver) IsOpen(v *Valve) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.open[v.ID], nil
+}
+
+// copy of all transitions recorded so far, oldest first
+func (d *FakeDriver) Transitions() []ValveTransition {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]ValveTransition(nil), d.transitions...)
+}
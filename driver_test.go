@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestFakeDriverWater(t *testing.T) {
+	c := &Config{
+		Driver: "fake",
+		Valves: []*Valve{
+			&Valve{ID: "1", Name: "test"},
+		},
+	}
+	err := c.InitDrivers()
+	if err != nil {
+		t.Fatalf("could not init drivers: %v", err)
+	}
+	v := c.Valves[0]
+	fake := v.Device.(*FakeDriver)
+
+	err = v.Water(context.Background(), c, 1)
+	if err != nil {
+		t.Errorf("could not water: %v", err)
+	}
+
+	trs := fake.Transitions()
+	if len(trs) != 2 {
+		t.Fatalf("expected 2 transitions, got %v", len(trs))
+	}
+	if !trs[0].Open || trs[1].Open {
+		t.Errorf("expected open then close, got %+v", trs)
+	}
+	if trs[1].Time.Sub(trs[0].Time).Seconds() < 1 {
+		t.Errorf("valve closed too soon, open for %v", trs[1].Time.Sub(trs[0].Time))
+	}
+	open, _ := fake.IsOpen(v)
+	if open {
+		t.Error("expected valve to be closed after water")
+	}
+}
+
+func TestUnknownDriver(t *testing.T) {
+	c := &Config{
+		Driver: "nope",
+		Valves: []*Valve{
+			&Valve{ID: "1", Name: "test"},
+		},
+	}
+	if c.InitDrivers() == nil {
+		t.Error("expected error for unknown driver, got nil")
+	}
+}
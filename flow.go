@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+Pulse output flow meter on the mainline, read through a gpio chardev line.
+Every run records the litres that went through the meter while its valve was open,
+and timepoints can ask for a volume (volume_l) instead of a duration,
+in which case the timepoint's duration is the timeout for reaching that volume.
+
+With a single meter on the mainline, per-valve volumes are only accurate when
+valves run one at a time, i.e. max_concurrent_valves is 1
+*/
+
+// how often volume runs check the flow meter
+const flowPollInterval = 250 * time.Millisecond
+
+// source of a running pulse total
+type PulseCounter interface {
+	Count() (uint64, error)
+	Close() error
+}
+
+type FlowMeter struct {
+	Chip           string       `json:"chip"`             // gpio chip the meter's pulse output is wired to
+	Line           int          `json:"line"`             // line offset on chip
+	PulsesPerLitre float32      `json:"pulses_per_litre"` // from the meter's datasheet, often given as a K factor
+	Counter        PulseCounter `json:"-"`                // set by InitFlowMeter, or directly in tests
+
+	// flow alarms, see leak.go, thresholds of 0 disable the alarm
+	CheckInterval  int     `json:"check_interval"`   // seconds between flow readings, defaults to 10
+	SettleTime     int     `json:"settle_time"`      // seconds after a valve opens or closes before flow is judged
+	LeakRate       float32 `json:"leak_rate"`        // L/min with every valve closed that counts as a leak
+	NoFlowRate     float32 `json:"no_flow_rate"`     // L/min below which an open valve counts as having no flow
+	HighFlowFactor float32 `json:"high_flow_factor"` // multiple of a zone's baseline flow that counts as a broken head
+	ShutoffMaster  bool    `json:"shutoff_master"`   // shut the master valve on leak and high flow alarms
+}
+
+// start counting pulses on the configured flow meter line
+func (c *Config) InitFlowMeter() error {
+	if c.FlowMeter == nil || c.FlowMeter.Counter != nil {
+		return nil
+	}
+	pc, err := NewChardevPulseCounter(c.FlowMeter.Chip, c.FlowMeter.Line, 0)
+	if err != nil {
+		return fmt.Errorf("could not start flow meter: %v", err)
+	}
+	c.FlowMeter.Counter = pc
+	return nil
+}
+
+// litres measured since the given pulse count
+func (fm *FlowMeter) LitresSince(start uint64) (float32, error) {
+	n, err := fm.Counter.Count()
+	if err != nil {
+		return 0, fmt.Errorf("could not read flow meter: %v", err)
+	}
+	return float32(n-start) / fm.PulsesPerLitre, nil
+}
+
+// open valve until the flow meter has measured the given volume, or until timeout seconds have passed.
+// returns the litres delivered, the valve is always closed before returning
+func (v *Valve) WaterVolume(ctx context.Context, c *Config, litres float32, timeout int) (float32, error) {
+	fm := c.FlowMeter
+	if fm == nil || fm.Counter == nil {
+		return 0, fmt.Errorf("volume watering on valve %v needs a flow meter", v.ID)
+	}
+	start, err := fm.Counter.Count()
+	if err != nil {
+		return 0, fmt.Errorf("could not read flow meter: %v", err)
+	}
+
+	var delivered float32
+	var readErr error
+	err = v.waterUntil(ctx, timeout, func() bool {
+		delivered, readErr = fm.LitresSince(start)
+		return readErr != nil || delivered >= litres
+	})
+	if err != nil {
+		return delivered, err
+	}
+	if readErr != nil {
+		return delivered, readErr
+	}
+	delivered, err = fm.LitresSince(start)
+	if err != nil {
+		return 0, err
+	}
+	if delivered < litres {
+		return delivered, fmt.Errorf("timed out after %vs with %.1fL of %.1fL delivered", timeout, delivered, litres)
+	}
+	return delivered, nil
+}
+
+// in-memory pulse counter for tests and for running without a meter
+type FakePulseCounter struct {
+	mu    sync.Mutex
+	count uint64
+}
+
+func (pc *FakePulseCounter) Add(n uint64) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.count += n
+}
+
+func (pc *FakePulseCounter) Count() (uint64, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.count, nil
+}
+
+func (pc *FakePulseCounter) Close() error {
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// add pulses to the counter while the valve is open, like water through a meter
+func simulateFlow(ctx context.Context, v *Valve, pc *FakePulseCounter, pulsesPerTick uint64) {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if open, _ := v.Device.IsOpen(v); open {
+				pc.Add(pulsesPerTick)
+			}
+		}
+	}
+}
+
+func TestWaterVolume(t *testing.T) {
+	c := testRunConfig(t, "1")
+	pc := &FakePulseCounter{}
+	c.FlowMeter = &FlowMeter{PulsesPerLitre: 100, Counter: pc}
+	v := c.Valves[0]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go simulateFlow(ctx, v, pc, 10)
+
+	// 10 pulses every 50ms is 2L/s, so 1L should take around half a second
+	start := time.Now()
+	litres, err := v.WaterVolume(context.Background(), c, 1, 10)
+	if err != nil {
+		t.Fatalf("could not water by volume: %v", err)
+	}
+	if litres < 1 {
+		t.Errorf("expected at least 1L delivered, got %v", litres)
+	}
+	if time.Since(start) > 3*time.Second {
+		t.Errorf("valve stayed open too long after reaching volume: %v", time.Since(start))
+	}
+	open, _ := v.Device.IsOpen(v)
+	if open {
+		t.Error("expected valve to be closed after reaching volume")
+	}
+
+	// no flow, so the timeout closes the valve
+	cancel()
+	_, err = v.WaterVolume(context.Background(), c, 1, 1)
+	if err == nil {
+		t.Error("expected timeout error with no flow")
+	}
+}
+
+func TestRunRecordsLitres(t *testing.T) {
+	c := testRunConfig(t, "1")
+	pc := &FakePulseCounter{}
+	c.FlowMeter = &FlowMeter{PulsesPerLitre: 100, Counter: pc}
+	m := NewRunManager(c)
+	var finished *Run
+	m.OnFinish = func(r *Run) {
+		finished = r
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go simulateFlow(ctx, c.Valves[0], pc, 10)
+
+	err := m.Enqueue(&Run{Valve: c.Valves[0], Duration: 1})
+	if err != nil {
+		t.Fatalf("could not queue run: %v", err)
+	}
+	m.Wait()
+	if finished == nil || finished.Litres <= 0 {
+		t.Errorf("expected run to record delivered litres, got %+v", finished)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+Tipping-bucket rain gauge as a local source of past precipitation.
+Bucket tips are counted on a gpio line and added up per hour in a store file,
+so the history survives restarts. When deciding whether to water, the gauge's total
+for the lookback period replaces or is blended with the weather api's past hours,
+depending on mode:
+- "replace": only the gauge is used, and the weather history api isn't called
+- "blend": the mean of the gauge and the api
+- "max": whichever of the two saw more rain
+When use_weather is off or the weather api fails, the gauge's total is used on its own
+whatever the mode, with no forecast or current conditions, see GaugeWeather
+*/
+
+// how often tips are collected into the store
+const gaugeRecordInterval = 10 * time.Second
+
+// how long hourly totals are kept in the store
+const gaugeRetention = 7 * 24 * time.Hour
+
+type RainGauge struct {
+	Chip      string       `json:"chip"`       // gpio chip the gauge's reed switch is wired to
+	Line      int          `json:"line"`       // line offset on chip
+	MMPerTip  float32      `json:"mm_per_tip"` // rainfall per bucket tip, from the gauge's datasheet
+	Debounce  int          `json:"debounce"`   // ms to debounce the reed switch, defaults to 20
+	StoreFile string       `json:"store_file"` // file to keep hourly totals in
+	Mode      string       `json:"mode"`       // "replace" (default), "blend" or "max"
+	Counter   PulseCounter `json:"-"`          // set by InitRainGauge, or directly in tests
+	Store     *PrecipStore `json:"-"`
+}
+
+// hourly precipitation totals persisted to a json file
+type PrecipStore struct {
+	path  string
+	mu    sync.Mutex
+	Hours map[string]float32 `json:"hours"` // mm keyed by the start of the hour, utc
+}
+
+func precipKey(t time.Time) string {
+	return t.UTC().Truncate(time.Hour).Format(time.RFC3339)
+}
+
+// load a store from file, starting empty if the file doesn't exist yet
+func LoadPrecipStore(path string) (*PrecipStore, error) {
+	ps := &PrecipStore{path: path, Hours: make(map[string]float32)}
+	f, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ps, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read precipitation store: %v", err)
+	}
+	err = json.Unmarshal(f, ps)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse precipitation store: %v", err)
+	}
+	if ps.Hours == nil {
+		ps.Hours = make(map[string]float32)
+	}
+	return ps, nil
+}
+
+// add rainfall to the hour containing t, dropping hours older than the retention period, and save
+func (ps *PrecipStore) Add(t time.Time, mm float32) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.Hours[precipKey(t)] += mm
+	cutoff := precipKey(time.Now().Add(-gaugeRetention))
+	for k := range ps.Hours {
+		// rfc3339 utc keys sort in time order
+		if k < cutoff {
+			delete(ps.Hours, k)
+		}
+	}
+
+	b, err := json.Marshal(ps)
+	if err != nil {
+		return fmt.Errorf("could not encode precipitation store: %v", err)
+	}
+	tmp := ps.path + ".tmp"
+	err = os.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return fmt.Errorf("could not write precipitation store: %v", err)
+	}
+	err = os.Rename(tmp, ps.path)
+	if err != nil {
+		return fmt.Errorf("could not write precipitation store: %v", err)
+	}
+	return nil
+}
+
+// total rainfall in hours starting strictly between from and to
+func (ps *PrecipStore) Sum(from time.Time, to time.Time) float32 {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var sum float32
+	for k, mm := range ps.Hours {
+		t, err := time.Parse(time.RFC3339, k)
+		if err != nil {
+			continue
+		}
+		if t.After(from) && t.Before(to) {
+			sum += mm
+		}
+	}
+	return sum
+}
+
+// load the gauge's store and start counting tips, if configured
+func (c *Config) InitRainGauge() error {
+	rg := c.RainGauge
+	if rg == nil {
+		return nil
+	}
+	if rg.Store == nil {
+		ps, err := LoadPrecipStore(rg.StoreFile)
+		if err != nil {
+			return err
+		}
+		rg.Store = ps
+	}
+	if rg.Counter == nil {
+		debounce := rg.Debounce
+		if debounce <= 0 {
+			debounce = 20
+		}
+		pc, err := NewChardevPulseCounter(rg.Chip, rg.Line, uint32(debounce*1000))
+		if err != nil {
+			return fmt.Errorf("could not start rain gauge: %v", err)
+		}
+		rg.Counter = pc
+	}
+	return nil
+}
+
+// move tips counted since last into the store, returns the new count to pass next time
+func (rg *RainGauge) Collect(now time.Time, last uint64) (uint64, error) {
+	n, err := rg.Counter.Count()
+	if err != nil {
+		return last, fmt.Errorf("could not read rain gauge: %v", err)
+	}
+	if n == last {
+		return n, nil
+	}
+	err = rg.Store.Add(now, float32(n-last)*rg.MMPerTip)
+	if err != nil {
+		return last, err
+	}
+	return n, nil
+}
+
+// collect tips into the store until ctx is done
+func (rg *RainGauge) Record(ctx context.Context, onError func(error)) {
+	ticker := time.NewTicker(gaugeRecordInterval)
+	defer ticker.Stop()
+	last, err := rg.Counter.Count()
+	if err != nil {
+		onError(fmt.Errorf("could not read rain gauge: %v", err))
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			last, err = rg.Collect(now, last)
+			if err != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// rainfall measured by the gauge over the lookback period, using the same window as ParseWeatherTimeline
+func (rg *RainGauge) PastPrecip(c *Config, now time.Time) float32 {
+	return rg.Store.Sum(now.Add(time.Duration(-c.RainLookback-1)*time.Hour), now)
+}
+
+// weather data with only the gauge's lookback precipitation, for when the weather api is off or fails,
+// nil without a rain gauge
+func (c *Config) GaugeWeather(now time.Time) *WeatherData {
+	if c.RainGauge == nil || c.RainGauge.Store == nil {
+		return nil
+	}
+	return &WeatherData{PastPrecip: c.RainGauge.PastPrecip(c, now)}
+}
+
+// replace or blend the api's lookback precipitation with the gauge's, according to mode
+func (rg *RainGauge) Apply(c *Config, now time.Time, data *WeatherData) {
+	gauge := rg.PastPrecip(c, now)
+	switch rg.Mode {
+	case "blend":
+		data.PastPrecip = (data.PastPrecip + gauge) / 2
+	case "max":
+		if gauge > data.PastPrecip {
+			data.PastPrecip = gauge
+		}
+	default:
+		data.PastPrecip = gauge
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPrecipStore(t *testing.T) {
+	path := t.TempDir() + "/gauge.json"
+	ps, err := LoadPrecipStore(path)
+	if err != nil {
+		t.Fatalf("could not load empty store: %v", err)
+	}
+
+	now := time.Now()
+	_ = ps.Add(now.Add(-30*time.Minute), 1.5)
+	_ = ps.Add(now.Add(-25*time.Minute), 1.0)
+	_ = ps.Add(now.Add(-3*time.Hour), 2.0)
+	_ = ps.Add(now.Add(-10*time.Hour), 4.0)
+	_ = ps.Add(now.Add(-8*24*time.Hour), 8.0)
+
+	// reload to make sure totals survive a restart
+	ps, err = LoadPrecipStore(path)
+	if err != nil {
+		t.Fatalf("could not reload store: %v", err)
+	}
+	if len(ps.Hours) != 3 {
+		t.Errorf("expected 3 hours kept after retention, got %v", len(ps.Hours))
+	}
+	if sum := ps.Sum(now.Add(-7*time.Hour), now); sum != 4.5 {
+		t.Errorf("expected 4.5mm in lookback, got %v", sum)
+	}
+}
+
+func TestRainGaugeApply(t *testing.T) {
+	pc := &FakePulseCounter{}
+	ps, _ := LoadPrecipStore(t.TempDir() + "/gauge.json")
+	rg := &RainGauge{MMPerTip: 0.5, Counter: pc, Store: ps}
+	c := &Config{RainLookback: 6, RainGauge: rg}
+	now := time.Now()
+
+	pc.Add(8)
+	last, err := rg.Collect(now.Add(-time.Hour), 0)
+	if err != nil || last != 8 {
+		t.Fatalf("could not collect tips: %v (%v)", last, err)
+	}
+
+	cases := map[string]float32{
+		"replace": 4,
+		"blend":   7,
+		"max":     10,
+	}
+	for mode, expected := range cases {
+		rg.Mode = mode
+		data := &WeatherData{PastPrecip: 10}
+		rg.Apply(c, now, data)
+		if data.PastPrecip != expected {
+			t.Errorf("expected %vmm in %v mode, got %v", expected, mode, data.PastPrecip)
+		}
+	}
+}
+
+func TestRainGaugeWithoutWeather(t *testing.T) {
+	pc := &FakePulseCounter{}
+	ps, _ := LoadPrecipStore(t.TempDir() + "/gauge.json")
+	rg := &RainGauge{MMPerTip: 0.5, Counter: pc, Store: ps, Mode: "blend"}
+	c := &Config{RainLookback: 6, RainThreshold: 3, RainGauge: rg}
+	pc.Add(8)
+	_, err := rg.Collect(time.Now().Add(-time.Hour), 0)
+	if err != nil {
+		t.Fatalf("could not collect tips: %v", err)
+	}
+
+	// weather api off, e.g. while offline, the gauge alone decides
+	data, err := GetWeatherTimeline(c)
+	if err != nil || data == nil || data.PastPrecip != 4 {
+		t.Fatalf("expected 4mm from the gauge, got %+v (%v)", data, err)
+	}
+	if ShouldWater(c, data, &WaterTimepoint{Type: "primary"}, nil) {
+		t.Error("expected primary timepoint to be skipped on gauge rain")
+	}
+	if ShouldWater(c, data, &WaterTimepoint{Type: "secondary"}, nil) {
+		t.Error("expected secondary timepoint to be skipped without current weather")
+	}
+	msg := FormatEventMessage(data, "N/A", "1", "test", true)
+	if msg != "Valve: 1 (test) || Lookback Precip: 4mm || Water Duration: N/As" {
+		t.Errorf("unexpected event message %q", msg)
+	}
+}
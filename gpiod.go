@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+/*
+Valve backend using the kernel GPIO character device (/dev/gpiochipN).
+Unlike rpio this doesn't touch /dev/gpiomem, so it works on the Raspberry Pi 5 (RP1)
+and on non-Pi boards. Valves select a line with the chip and line config fields.
+
+Line requests use the v2 uAPI from include/uapi/linux/gpio.h, the structs below
+mirror the kernel layout and must not be reordered.
+*/
+
+const (
+	gpioV2LineFlagActiveLow   = 1 << 1
+	gpioV2LineFlagInput       = 1 << 2
+	gpioV2LineFlagOutput      = 1 << 3
+	gpioV2LineFlagEdgeRising  = 1 << 4
+	gpioV2LineFlagBiasPullUp  = 1 << 8
+	gpioV2LineEventSize       = 48 // sizeof(struct gpio_v2_line_event)
+	gpioV2LineEventLineSeqOff = 20 // offset of line_seqno within the event
+
+	gpioV2LineAttrIDOutputValues = 2
+	gpioV2LineAttrIDDebounce     = 3
+
+	gpioConsumer = "irrigation-system"
+)
+
+type gpioV2LineAttribute struct {
+	ID      uint32
+	Padding uint32
+	Value   uint64 // union of flags, output values and debounce period
+}
+
+type gpioV2LineConfigAttribute struct {
+	Attr gpioV2LineAttribute
+	Mask uint64
+}
+
+type gpioV2LineConfig struct {
+	Flags    uint64
+	NumAttrs uint32
+	Padding  [5]uint32
+	Attrs    [10]gpioV2LineConfigAttribute
+}
+
+type gpioV2LineRequest struct {
+	Offsets         [64]uint32
+	Consumer        [32]byte
+	Config          gpioV2LineConfig
+	NumLines        uint32
+	EventBufferSize uint32
+	Padding         [5]uint32
+	Fd              int32
+}
+
+type gpioV2LineValues struct {
+	Bits uint64
+	Mask uint64
+}
+
+// equivalent of the _IOWR macro for the gpio ioctl type
+func gpioIOWR(nr uintptr, size uintptr) uintptr {
+	return (3 << 30) | (size << 16) | (0xB4 << 8) | nr
+}
+
+var (
+	gpioV2GetLineIoctl       = gpioIOWR(0x07, unsafe.Sizeof(gpioV2LineRequest{}))
+	gpioV2LineGetValuesIoctl = gpioIOWR(0x0E, unsafe.Sizeof(gpioV2LineValues{}))
+	gpioV2LineSetValuesIoctl = gpioIOWR(0x0F, unsafe.Sizeof(gpioV2LineValues{}))
+)
+
+func ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// a single requested gpio line
+type GPIOLine interface {
+	SetValue(value int) error
+	Value() (int, error)
+	Close() error
+}
+
+// gpio line requested from a character device
+type ChardevLine struct {
+	fd int
+}
+
+// accept either a bare chip name (gpiochip0) or a full device path
+func gpioChipPath(chip string) string {
+	if strings.HasPrefix(chip, "/") {
+		return chip
+	}
+	return "/dev/" + chip
+}
+
+// request a single line on a gpio chip
+func requestLine(chip string, line int, flags uint64, attrs ...gpioV2LineConfigAttribute) (*ChardevLine, error) {
+	path := gpioChipPath(chip)
+	cfd, err := syscall.Open(path, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not open gpio chip %v: %v", path, err)
+	}
+	// the line fd outlives the chip fd
+	defer syscall.Close(cfd)
+
+	var req gpioV2LineRequest
+	req.Offsets[0] = uint32(line)
+	req.NumLines = 1
+	copy(req.Consumer[:len(req.Consumer)-1], gpioConsumer)
+	req.Config.Flags = flags
+	req.Config.NumAttrs = uint32(copy(req.Config.Attrs[:], attrs))
+
+	err = ioctl(cfd, gpioV2GetLineIoctl, unsafe.Pointer(&req))
+	if err != nil {
+		return nil, fmt.Errorf("could not request line %v on %v: %v", line, path, err)
+	}
+	return &ChardevLine{fd: int(req.Fd)}, nil
+}
+
+// request a line as an output, initially inactive
+func RequestOutputLine(chip string, line int, activeLow bool) (*ChardevLine, error) {
+	var flags uint64 = gpioV2LineFlagOutput
+	if activeLow {
+		flags |= gpioV2LineFlagActiveLow
+	}
+	initial := gpioV2LineConfigAttribute{
+		Attr: gpioV2LineAttribute{ID: gpioV2LineAttrIDOutputValues, Value: 0},
+		Mask: 1,
+	}
+	return requestLine(chip, line, flags, initial)
+}
+
+// request a line as an input, with the internal pull-up enabled
+func RequestInputLine(chip string, line int) (*ChardevLine, error) {
+	return requestLine(chip, line, gpioV2LineFlagInput|gpioV2LineFlagBiasPullUp)
+}
+
+// request a line as an input that reports rising edges, with the internal pull-up enabled.
+// a non-zero debounce filters out edges from a bouncing switch
+func RequestEdgeLine(chip string, line int, debounceUs uint32) (*ChardevLine, error) {
+	flags := uint64(gpioV2LineFlagInput | gpioV2LineFlagEdgeRising | gpioV2LineFlagBiasPullUp)
+	if debounceUs == 0 {
+		return requestLine(chip, line, flags)
+	}
+	debounce := gpioV2LineConfigAttribute{
+		Attr: gpioV2LineAttribute{ID: gpioV2LineAttrIDDebounce, Value: uint64(debounceUs)},
+		Mask: 1,
+	}
+	return requestLine(chip, line, flags, debounce)
+}
+
+func (l *ChardevLine) SetValue(value int) error {
+	vals := gpioV2LineValues{Mask: 1}
+	if value != 0 {
+		vals.Bits = 1
+	}
+	err := ioctl(l.fd, gpioV2LineSetValuesIoctl, unsafe.Pointer(&vals))
+	if err != nil {
+		return fmt.Errorf("could not set line value: %v", err)
+	}
+	return nil
+}
+
+func (l *ChardevLine) Value() (int, error) {
+	vals := gpioV2LineValues{Mask: 1}
+	err := ioctl(l.fd, gpioV2LineGetValuesIoctl, unsafe.Pointer(&vals))
+	if err != nil {
+		return 0, fmt.Errorf("could not get line value: %v", err)
+	}
+	return int(vals.Bits & 1), nil
+}
+
+func (l *ChardevLine) Close() error {
+	return syscall.Close(l.fd)
+}
+
+// counts rising edges on a gpio line using kernel edge events
+type ChardevPulseCounter struct {
+	line  *ChardevLine
+	count atomic.Uint64
+}
+
+func NewChardevPulseCounter(chip string, line int, debounceUs uint32) (*ChardevPulseCounter, error) {
+	l, err := RequestEdgeLine(chip, line, debounceUs)
+	if err != nil {
+		return nil, err
+	}
+	pc := &ChardevPulseCounter{line: l}
+	go pc.watch()
+	return pc, nil
+}
+
+// read edge events until the line is closed. The kernel numbers events per line,
+// so using the sequence number keeps the count right even if the event buffer overflows
+func (pc *ChardevPulseCounter) watch() {
+	buf := make([]byte, gpioV2LineEventSize*16)
+	for {
+		n, err := syscall.Read(pc.line.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || n <= 0 {
+			return
+		}
+		last := buf[(n/gpioV2LineEventSize-1)*gpioV2LineEventSize:]
+		pc.count.Store(uint64(binary.NativeEndian.Uint32(last[gpioV2LineEventLineSeqOff:])))
+	}
+}
+
+func (pc *ChardevPulseCounter) Count() (uint64, error) {
+	return pc.count.Load(), nil
+}
+
+func (pc *ChardevPulseCounter) Close() error {
+	return pc.line.Close()
+}
+
+// drives valves through gpio character device lines, using Valve.Chip and Valve.Line.
+// Lines are requested on first use and held for the life of the process
+type GpiodDriver struct {
+	mu      sync.Mutex
+	lines   map[string]GPIOLine
+	latched latchState
+	request func(chip string, line int, activeLow bool) (GPIOLine, error) // swappable for a fake chip in tests
+}
+
+func NewGpiodDriver() *GpiodDriver {
+	return &GpiodDriver{
+		lines:   make(map[string]GPIOLine),
+		latched: make(latchState),
+		request: func(chip string, line int, activeLow bool) (GPIOLine, error) {
+			return RequestOutputLine(chip, line, activeLow)
+		},
+	}
+}
+
+// look up or request one of a valve's lines, caller must hold the lock.
+// active low valves get active low lines, so values are always 1 for on
+func (d *GpiodDriver) line(v *Valve, offset int) (GPIOLine, error) {
+	if v.Chip == "" {
+		return nil, fmt.Errorf("valve %v has no gpio chip configured", v.ID)
+	}
+	key := fmt.Sprintf("%v:%v", gpioChipPath(v.Chip), offset)
+	l, ok := d.lines[key]
+	if ok {
+		return l, nil
+	}
+	l, err := d.request(v.Chip, offset, v.ActiveLow())
+	if err != nil {
+		return nil, err
+	}
+	d.lines[key] = l
+	return l, nil
+}
+
+func (d *GpiodDriver) drive(v *Valve, open bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.latched.drive(v, v.Line, open, func(offset int, active bool) error {
+		l, err := d.line(v, offset)
+		if err != nil {
+			return err
+		}
+		if active {
+			return l.SetValue(1)
+		}
+		return l.SetValue(0)
+	})
+}
+
+func (d *GpiodDriver) Open(v *Valve) error {
+	return d.drive(v, true)
+}
+
+func (d *GpiodDriver) Close(v *Valve) error {
+	return d.drive(v, false)
+}
+
+// reads the line value back, see latchState for latching valves
+func (d *GpiodDriver) IsOpen(v *Valve) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if v.Latching {
+		return d.latched[v.ID], nil
+	}
+	l, err := d.line(v, v.Line)
+	if err != nil {
+		return false, err
+	}
+	val, err := l.Value()
+	if err != nil {
+		return false, err
+	}
+	return val == 1, nil
+}
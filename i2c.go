@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+)
+
+/*
+Valves on I2C gpio expanders, for installs with more zones than the Pi has free pins.
+Valves using the "mcp23017" or "pcf8574" driver are addressed by Bus (/dev/i2c-N),
+Address and Port, the expander pin (0-15 on an MCP23017, GPA0-7 then GPB0-7, or 0-7 on a PCF8574).
+Polarity and latching work as they do for rpio pins, with OpenPin and ClosePin as expander pins.
+
+An expander's pins share one output register, so the driver keeps a copy of it and
+only changes the bits for the valve being driven. The MCP23017's registers are read back
+on first use, so pins left as they were by another program or a restart aren't disturbed.
+The PCF8574 has no registers to read back and powers up with every pin high
+*/
+
+// I2C_SLAVE from include/uapi/linux/i2c-dev.h
+const i2cSlave = 0x0703
+
+// MCP23017 registers, with IOCON.BANK at its power-on default of 0 so A and B registers are adjacent
+const (
+	mcp23017IODIRA = 0x00
+	mcp23017OLATA  = 0x14
+)
+
+// bus that can address several I2C devices
+type I2CBus interface {
+	Write(addr uint16, b []byte) error
+	Read(addr uint16, b []byte) error
+}
+
+// i2c-dev bus, e.g. /dev/i2c-1
+type I2CDev struct {
+	Path string
+	mu   sync.Mutex
+	fd   int
+	open bool
+}
+
+// open the device on first use and select the target address, caller must hold the lock
+func (b *I2CDev) target(addr uint16) error {
+	if !b.open {
+		fd, err := syscall.Open(b.Path, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("could not open i2c bus %v: %v", b.Path, err)
+		}
+		b.fd = fd
+		b.open = true
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(b.fd), i2cSlave, uintptr(addr))
+	if errno != 0 {
+		return fmt.Errorf("could not address i2c device %#x: %v", addr, errno)
+	}
+	return nil
+}
+
+func (b *I2CDev) Write(addr uint16, p []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	err := b.target(addr)
+	if err != nil {
+		return err
+	}
+	n, err := syscall.Write(b.fd, p)
+	if err != nil {
+		return fmt.Errorf("could not write to i2c device %#x: %v", addr, err)
+	}
+	if n != len(p) {
+		return fmt.Errorf("short write to i2c device %#x", addr)
+	}
+	return nil
+}
+
+func (b *I2CDev) Read(addr uint16, p []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	err := b.target(addr)
+	if err != nil {
+		return err
+	}
+	n, err := syscall.Read(b.fd, p)
+	if err != nil {
+		return fmt.Errorf("could not read from i2c device %#x: %v", addr, err)
+	}
+	if n != len(p) {
+		return fmt.Errorf("short read from i2c device %#x", addr)
+	}
+	return nil
+}
+
+// shadow of one expander's direction and output registers, bit n is pin n
+type expanderState struct {
+	dir  uint16 // 1 for input, as in IODIR
+	olat uint16
+}
+
+// drives valves on MCP23017 or PCF8574 expanders
+type ExpanderDriver struct {
+	Kind    string // "mcp23017" or "pcf8574"
+	mu      sync.Mutex
+	buses   map[int]I2CBus
+	chips   map[string]*expanderState     // keyed by bus:address
+	latched latchState                    // latching valves, see latchState
+	openBus func(bus int) (I2CBus, error) // swappable for a fake bus in tests
+}
+
+func NewExpanderDriver(kind string) *ExpanderDriver {
+	return &ExpanderDriver{
+		Kind:    kind,
+		buses:   make(map[int]I2CBus),
+		chips:   make(map[string]*expanderState),
+		latched: make(latchState),
+		openBus: func(bus int) (I2CBus, error) {
+			return &I2CDev{Path: fmt.Sprintf("/dev/i2c-%v", bus)}, nil
+		},
+	}
+}
+
+// number of pins on the expander
+func (d *ExpanderDriver) pins() int {
+	if d.Kind == "mcp23017" {
+		return 16
+	}
+	return 8
+}
+
+// look up or open a valve's bus, and read its expander's registers on first use.
+// caller must hold the lock
+func (d *ExpanderDriver) chip(v *Valve) (I2CBus, *expanderState, error) {
+	bus, ok := d.buses[v.Bus]
+	if !ok {
+		var err error
+		bus, err = d.openBus(v.Bus)
+		if err != nil {
+			return nil, nil, err
+		}
+		d.buses[v.Bus] = bus
+	}
+	key := fmt.Sprintf("%v:%v", v.Bus, v.Address)
+	st, ok := d.chips[key]
+	if ok {
+		return bus, st, nil
+	}
+
+	addr := uint16(v.Address)
+	st = &expanderState{dir: 0xffff, olat: 0xffff}
+	if d.Kind == "mcp23017" {
+		regs := make([]byte, 2)
+		err := readRegs(bus, addr, mcp23017IODIRA, regs)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read mcp23017 %#x: %v", addr, err)
+		}
+		st.dir = uint16(regs[0]) | uint16(regs[1])<<8
+		err = readRegs(bus, addr, mcp23017OLATA, regs)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read mcp23017 %#x: %v", addr, err)
+		}
+		st.olat = uint16(regs[0]) | uint16(regs[1])<<8
+	}
+	d.chips[key] = st
+	return bus, st, nil
+}
+
+// read consecutive registers, starting at reg
+func readRegs(bus I2CBus, addr uint16, reg byte, b []byte) error {
+	err := bus.Write(addr, []byte{reg})
+	if err != nil {
+		return err
+	}
+	return bus.Read(addr, b)
+}
+
+// drive an expander pin to the valve's active or idle level, caller must hold the lock
+func (d *ExpanderDriver) set(v *Valve, pin int, active bool) error {
+	if pin < 0 || pin >= d.pins() {
+		return fmt.Errorf("pin %v out of range for %v on valve %v", pin, d.Kind, v.ID)
+	}
+	bus, st, err := d.chip(v)
+	if err != nil {
+		return err
+	}
+	addr := uint16(v.Address)
+	olat := st.olat &^ (1 << pin)
+	if active != v.ActiveLow() {
+		olat |= 1 << pin
+	}
+
+	if d.Kind == "pcf8574" {
+		err = bus.Write(addr, []byte{byte(olat)})
+		if err != nil {
+			return fmt.Errorf("could not write pcf8574 %#x: %v", addr, err)
+		}
+		st.olat = olat
+		return nil
+	}
+
+	// OLAT before IODIR, see Valve.ActiveLow
+	err = bus.Write(addr, []byte{mcp23017OLATA, byte(olat), byte(olat >> 8)})
+	if err != nil {
+		return fmt.Errorf("could not write mcp23017 %#x: %v", addr, err)
+	}
+	st.olat = olat
+	if st.dir&(1<<pin) != 0 {
+		dir := st.dir &^ (1 << pin)
+		err = bus.Write(addr, []byte{mcp23017IODIRA, byte(dir), byte(dir >> 8)})
+		if err != nil {
+			return fmt.Errorf("could not write mcp23017 %#x: %v", addr, err)
+		}
+		st.dir = dir
+	}
+	return nil
+}
+
+func (d *ExpanderDriver) drive(v *Valve, open bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.latched.drive(v, v.Port, open, func(pin int, active bool) error {
+		return d.set(v, pin, active)
+	})
+}
+
+func (d *ExpanderDriver) Open(v *Valve) error {
+	return d.drive(v, true)
+}
+
+func (d *ExpanderDriver) Close(v *Valve) error {
+	return d.drive(v, false)
+}
+
+// reads the pin back from the expander, see latchState for latching valves
+func (d *ExpanderDriver) IsOpen(v *Valve) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if v.Latching {
+		return d.latched[v.ID], nil
+	}
+	bus, _, err := d.chip(v)
+	if err != nil {
+		return false, err
+	}
+	addr := uint16(v.Address)
+	var level uint16
+	if d.Kind == "pcf8574" {
+		b := make([]byte, 1)
+		err = bus.Read(addr, b)
+		level = uint16(b[0])
+	} else {
+		b := make([]byte, 2)
+		err = readRegs(bus, addr, mcp23017OLATA, b)
+		level = uint16(b[0]) | uint16(b[1])<<8
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not read %v %#x: %v", d.Kind, addr, err)
+	}
+	return (level&(1<<v.Port) != 0) != v.ActiveLow(), nil
+}
+
+// in-memory I2C bus, for tests. devices added with registers behave like an MCP23017,
+// a write sets the register pointer then fills registers from it, a read continues from the pointer.
+// devices without registers behave like a PCF8574, holding a single byte
+type FakeI2CBus struct {
+	mu      sync.Mutex
+	devices map[uint16]*fakeI2CDevice
+}
+
+type fakeI2CDevice struct {
+	registers bool
+	regs      [256]byte
+	ptr       byte
+}
+
+func NewFakeI2CBus() *FakeI2CBus {
+	return &FakeI2CBus{devices: make(map[uint16]*fakeI2CDevice)}
+}
+
+// attach a device to the bus, starting with every register set to init
+func (b *FakeI2CBus) AddDevice(addr uint16, registers bool, init byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	dev := &fakeI2CDevice{registers: registers}
+	for i := range dev.regs {
+		dev.regs[i] = init
+	}
+	b.devices[addr] = dev
+}
+
+// current value of a device's register, use 0 for devices without registers
+func (b *FakeI2CBus) Reg(addr uint16, reg byte) byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	dev, ok := b.devices[addr]
+	if !ok {
+		return 0
+	}
+	return dev.regs[reg]
+}
+
+func (b *FakeI2CBus) Write(addr uint16, p []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	dev, ok := b.devices[addr]
+	if !ok {
+		return fmt.Errorf("no device at %#x", addr)
+	}
+	if !dev.registers {
+		if len(p) > 0 {
+			dev.regs[0] = p[len(p)-1]
+		}
+		return nil
+	}
+	if len(p) == 0 {
+		return nil
+	}
+	dev.ptr = p[0]
+	for _, v := range p[1:] {
+		dev.regs[dev.ptr] = v
+		dev.ptr++
+	}
+	return nil
+}
+
+func (b *FakeI2CBus) Read(addr uint16, p []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	dev, ok := b.devices[addr]
+	if !ok {
+		return fmt.Errorf("no device at %#x", addr)
+	}
+	for i := range p {
+		if !dev.registers {
+			p[i] = dev.regs[0]
+			continue
+		}
+		p[i] = dev.regs[dev.ptr]
+		dev.ptr++
+	}
+	return nil
+}
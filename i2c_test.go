@@ -0,0 +1,118 @@
+package main
+
+import "testing"
+
+func testExpanderDriver(kind string) (*ExpanderDriver, *FakeI2CBus) {
+	bus := NewFakeI2CBus()
+	d := NewExpanderDriver(kind)
+	d.openBus = func(n int) (I2CBus, error) {
+		return bus, nil
+	}
+	return d, bus
+}
+
+func TestMCP23017Driver(t *testing.T) {
+	d, bus := testExpanderDriver("mcp23017")
+	// power-on state, every pin an input
+	bus.AddDevice(0x20, true, 0x00)
+	bus.Write(0x20, []byte{mcp23017IODIRA, 0xff, 0xff})
+
+	v1 := &Valve{ID: "1", Bus: 1, Address: 0x20, Port: 2}
+	v2 := &Valve{ID: "2", Bus: 1, Address: 0x20, Port: 9, Polarity: "active_low"}
+
+	err := d.Open(v1)
+	if err != nil {
+		t.Fatalf("could not open valve: %v", err)
+	}
+	err = d.Close(v2)
+	if err != nil {
+		t.Fatalf("could not close valve: %v", err)
+	}
+	// only the valves' pins are made outputs, and the active low valve is idle high
+	if dir := bus.Reg(0x20, mcp23017IODIRA); dir != 0xfb {
+		t.Errorf("expected IODIRA 0xfb, got %#x", dir)
+	}
+	if dir := bus.Reg(0x20, mcp23017IODIRA+1); dir != 0xfd {
+		t.Errorf("expected IODIRB 0xfd, got %#x", dir)
+	}
+	if olat := bus.Reg(0x20, mcp23017OLATA); olat != 0x04 {
+		t.Errorf("expected OLATA 0x04, got %#x", olat)
+	}
+	if olat := bus.Reg(0x20, mcp23017OLATA+1); olat != 0x02 {
+		t.Errorf("expected OLATB 0x02, got %#x", olat)
+	}
+
+	open, err := d.IsOpen(v1)
+	if err != nil || !open {
+		t.Errorf("expected valve 1 to be open, got %v (%v)", open, err)
+	}
+	open, err = d.IsOpen(v2)
+	if err != nil || open {
+		t.Errorf("expected valve 2 to be closed, got %v (%v)", open, err)
+	}
+
+	err = d.Open(v2)
+	if err != nil {
+		t.Fatalf("could not open valve: %v", err)
+	}
+	if olat := bus.Reg(0x20, mcp23017OLATA+1); olat != 0x00 {
+		t.Errorf("expected OLATB 0x00 with active low valve open, got %#x", olat)
+	}
+	if olat := bus.Reg(0x20, mcp23017OLATA); olat != 0x04 {
+		t.Errorf("expected valve 1 to stay open, OLATA %#x", olat)
+	}
+
+	if d.Open(&Valve{ID: "3", Bus: 1, Address: 0x20, Port: 16}) == nil {
+		t.Error("expected error for pin out of range")
+	}
+	if d.Open(&Valve{ID: "4", Bus: 1, Address: 0x21}) == nil {
+		t.Error("expected error for missing device")
+	}
+}
+
+func TestPCF8574Driver(t *testing.T) {
+	d, bus := testExpanderDriver("pcf8574")
+	bus.AddDevice(0x27, false, 0xff)
+	v := &Valve{ID: "1", Bus: 1, Address: 0x27, Port: 3, Polarity: "active_low"}
+
+	err := d.Open(v)
+	if err != nil {
+		t.Fatalf("could not open valve: %v", err)
+	}
+	if b := bus.Reg(0x27, 0); b != 0xf7 {
+		t.Errorf("expected 0xf7 with valve open, got %#x", b)
+	}
+	open, err := d.IsOpen(v)
+	if err != nil || !open {
+		t.Errorf("expected valve to be open, got %v (%v)", open, err)
+	}
+	err = d.Close(v)
+	if err != nil {
+		t.Fatalf("could not close valve: %v", err)
+	}
+	if b := bus.Reg(0x27, 0); b != 0xff {
+		t.Errorf("expected 0xff with valve closed, got %#x", b)
+	}
+	if d.Open(&Valve{ID: "2", Bus: 1, Address: 0x27, Port: 8}) == nil {
+		t.Error("expected error for pin out of range")
+	}
+}
+
+func TestExpanderDriverLatching(t *testing.T) {
+	d, bus := testExpanderDriver("mcp23017")
+	bus.AddDevice(0x20, true, 0x00)
+	v := &Valve{ID: "1", Bus: 1, Address: 0x20, Latching: true, OpenPin: 0, ClosePin: 1, PulseWidth: 1}
+
+	err := d.Open(v)
+	if err != nil {
+		t.Fatalf("could not open valve: %v", err)
+	}
+	open, _ := d.IsOpen(v)
+	if !open {
+		t.Error("expected latching valve to report open")
+	}
+	// both sides of the h-bridge are left idle after the pulse
+	if olat := bus.Reg(0x20, mcp23017OLATA); olat != 0x00 {
+		t.Errorf("expected OLATA 0x00 after pulse, got %#x", olat)
+	}
+}
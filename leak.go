@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+/*
+Flow alarms, raised from periodic flow meter readings:
+- leak: flow while every valve is closed, e.g. a leak or a stuck solenoid
+- no flow: a valve is open but nothing comes through, e.g. a broken valve or clogged line
+- high flow: a zone draws far more than its learned baseline, e.g. a broken head
+
+Readings are only judged when the whole reading started flow_meter.settle_time or more after
+a valve last opened or closed, so flow from before the change isn't judged against the valves open after it.
+Each zone's baseline is a moving average of its flow rate while it runs alone, learned since startup.
+Alarms go through LogError once per occurrence, and leak and high flow alarms can shut the
+master valve, which then stays shut until the program is restarted
+*/
+
+// readings needed before a zone's baseline is trusted
+const minBaselineSamples = 5
+
+// weight of a new reading in a zone's baseline
+const baselineWeight = 0.2
+
+type flowBaseline struct {
+	rate    float32 // L/min
+	samples int
+}
+
+// read the flow meter every flow_meter.check_interval seconds and check for alarms, until ctx is done
+func (m *RunManager) MonitorFlow(ctx context.Context) {
+	defer RecoverValves(m.c)
+	fm := m.c.FlowMeter
+	if fm == nil || fm.Counter == nil {
+		return
+	}
+	interval := time.Duration(fm.CheckInterval) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last, err := fm.Counter.Count()
+	if err != nil {
+		logerr := LogError(m.c, fmt.Errorf("could not read flow meter: %v", err))
+		if logerr != nil {
+			log.Printf("could not log error: %v", logerr)
+		}
+	}
+	lastTime := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := fm.Counter.Count()
+			if err != nil {
+				logerr := LogError(m.c, fmt.Errorf("could not read flow meter: %v", err))
+				if logerr != nil {
+					log.Printf("could not log error: %v", logerr)
+				}
+				continue
+			}
+			litres := float32(n-last) / fm.PulsesPerLitre
+			rate := litres / float32(now.Sub(lastTime).Minutes())
+			m.CheckFlow(lastTime, rate)
+			last, lastTime = n, now
+		}
+	}
+}
+
+// judge a flow rate in L/min, read from from until now, against the valves that are currently open
+func (m *RunManager) CheckFlow(from time.Time, rate float32) {
+	fm := m.c.FlowMeter
+	open, changed := m.openZones()
+	if changed.Add(time.Duration(fm.SettleTime) * time.Second).After(from) {
+		return
+	}
+
+	if len(open) == 0 {
+		if fm.LeakRate > 0 && rate >= fm.LeakRate {
+			m.flowAlarm("leak", fmt.Errorf("flow of %.1fL/min with all valves closed, possible leak or stuck valve", rate), true)
+		} else {
+			m.clearFlowAlarm("leak")
+		}
+		return
+	}
+
+	names := make([]string, 0, len(open))
+	for _, r := range open {
+		names = append(names, fmt.Sprintf("%v (%v)", r.Valve.ID, r.Valve.Name))
+	}
+	noFlow := fm.NoFlowRate > 0 && rate < fm.NoFlowRate
+	if noFlow {
+		m.flowAlarm("noflow", fmt.Errorf("flow of %.1fL/min with valve %v open, possible broken valve or clogged line", rate, strings.Join(names, ", ")), false)
+	} else {
+		m.clearFlowAlarm("noflow")
+	}
+
+	// baselines are per zone, so they can only be judged and learned with one zone open
+	if len(open) != 1 || noFlow {
+		return
+	}
+	r := open[0]
+	key := "high:" + r.Valve.ID
+	m.mu.Lock()
+	b := m.baselines[r.Valve.ID]
+	m.mu.Unlock()
+	if fm.HighFlowFactor > 0 && b.samples >= minBaselineSamples && rate > b.rate*fm.HighFlowFactor {
+		m.flowAlarm(key, fmt.Errorf("flow of %.1fL/min on valve %v is over %v times its baseline of %.1fL/min, possible broken head", rate, names[0], fm.HighFlowFactor, b.rate), true)
+		m.Cancel(r.Valve.ID)
+		return
+	}
+	m.clearFlowAlarm(key)
+
+	if b.samples == 0 {
+		b.rate = rate
+	} else {
+		b.rate = b.rate*(1-baselineWeight) + rate*baselineWeight
+	}
+	b.samples++
+	m.mu.Lock()
+	m.baselines[r.Valve.ID] = b
+	m.mu.Unlock()
+}
+
+// learned flow rate for a valve in L/min, and whether enough readings have been seen to trust it
+func (m *RunManager) FlowBaseline(valveID string) (float32, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b := m.baselines[valveID]
+	return b.rate, b.samples >= minBaselineSamples
+}
+
+// runs whose valve is currently open, and when a valve last opened or closed
+func (m *RunManager) openZones() ([]*Run, time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	changed := m.lastEnd
+	open := make([]*Run, 0, len(m.running))
+	for _, r := range m.running {
+		if r.opened.IsZero() {
+			continue
+		}
+		open = append(open, r)
+		if r.opened.After(changed) {
+			changed = r.opened
+		}
+	}
+	return open, changed
+}
+
+// raise an alarm unless it's already active, optionally shutting the master valve
+func (m *RunManager) flowAlarm(key string, e error, shut bool) {
+	m.mu.Lock()
+	active := m.alarms[key]
+	m.alarms[key] = true
+	m.mu.Unlock()
+	if active {
+		return
+	}
+
+	if shut && m.c.FlowMeter.ShutoffMaster {
+		err := m.ShutMaster()
+		if err != nil {
+			e = fmt.Errorf("%v, could not shut master valve: %v", e, err)
+		} else {
+			e = fmt.Errorf("%v, master valve shut until restart", e)
+		}
+	}
+	logerr := LogError(m.c, e)
+	if logerr != nil {
+		log.Printf("could not log error: %v", logerr)
+	}
+}
+
+func (m *RunManager) clearFlowAlarm(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.alarms, key)
+}
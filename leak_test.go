@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testFlowConfig(t *testing.T) *Config {
+	c := testRunConfig(t, "1")
+	c.EventLogFile = t.TempDir() + "/events.log"
+	c.Master = &MasterValve{Valve: Valve{ID: "master", Name: "master"}}
+	c.FlowMeter = &FlowMeter{
+		PulsesPerLitre: 100,
+		Counter:        &FakePulseCounter{},
+		LeakRate:       0.5,
+		NoFlowRate:     0.5,
+		HighFlowFactor: 1.5,
+		ShutoffMaster:  true,
+	}
+	err := c.InitDrivers()
+	if err != nil {
+		t.Fatalf("could not init drivers: %v", err)
+	}
+	return c
+}
+
+func readLog(t *testing.T, c *Config) string {
+	b, err := os.ReadFile(c.EventLogFile)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("could not read log: %v", err)
+	}
+	return string(b)
+}
+
+func TestLeakAlarm(t *testing.T) {
+	c := testFlowConfig(t)
+	m := NewRunManager(c)
+
+	m.CheckFlow(time.Now(), 0.1)
+	if strings.Contains(readLog(t, c), "leak") {
+		t.Error("expected no leak alarm below leak rate")
+	}
+
+	m.CheckFlow(time.Now(), 2)
+	m.CheckFlow(time.Now(), 2)
+	if n := strings.Count(readLog(t, c), "possible leak"); n != 1 {
+		t.Errorf("expected leak alarm to be logged once, got %v", n)
+	}
+	if m.acquireMaster(context.Background()) == nil {
+		t.Error("expected master to stay shut after leak alarm")
+	}
+}
+
+func TestZoneFlowAlarms(t *testing.T) {
+	c := testFlowConfig(t)
+	m := NewRunManager(c)
+	v := c.Valves[0]
+
+	err := m.Enqueue(&Run{Valve: v, Duration: 30})
+	if err != nil {
+		t.Fatalf("could not queue run: %v", err)
+	}
+	defer m.CancelAll()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+		if open, _ := v.Device.IsOpen(v); open {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	m.CheckFlow(time.Now(), 0)
+	if !strings.Contains(readLog(t, c), "clogged line") {
+		t.Error("expected no flow alarm with valve open and no flow")
+	}
+
+	// learn a baseline, then jump well above it
+	for i := 0; i < minBaselineSamples; i++ {
+		m.CheckFlow(time.Now(), 10)
+	}
+	rate, ok := m.FlowBaseline(v.ID)
+	if !ok || rate < 9.9 || rate > 10.1 {
+		t.Errorf("expected learned baseline of 10L/min, got %v (%v)", rate, ok)
+	}
+	m.CheckFlow(time.Now(), 30)
+	if !strings.Contains(readLog(t, c), "broken head") {
+		t.Error("expected high flow alarm")
+	}
+	m.Wait()
+	if open, _ := v.Device.IsOpen(v); open {
+		t.Error("expected high flow alarm to stop the run")
+	}
+	if m.MasterOpen() {
+		t.Error("expected high flow alarm to shut the master")
+	}
+}
+
+func TestFlowSettle(t *testing.T) {
+	c := testFlowConfig(t)
+	m := NewRunManager(c)
+	start := time.Now()
+	err := m.Enqueue(&Run{Valve: c.Valves[0], Duration: 1})
+	if err != nil {
+		t.Fatalf("could not queue run: %v", err)
+	}
+	m.Wait()
+
+	// a reading that started while the zone was still running mustn't be judged as a leak
+	m.CheckFlow(start, 10)
+	if strings.Contains(readLog(t, c), "possible leak") {
+		t.Error("expected no leak alarm from a reading that covers the zone running")
+	}
+	m.CheckFlow(time.Now(), 10)
+	if !strings.Contains(readLog(t, c), "possible leak") {
+		t.Error("expected leak alarm from a reading after the zone closed")
+	}
+}
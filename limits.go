@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"time"
+)
+
+/*
+Runtime safety limits, so a typo in a duration can't run a zone for hours.
+A run longer than the valve's max single-run duration is truncated, and a run that would
+push the valve or the whole system past its daily runtime cap is truncated to what's left
+of the allowance, or refused when nothing is left. Either way it's reported through LogError.
+
+Daily runtime is counted per calendar day, by the day each run starts. It's kept in the state file
+when one is configured, so restarting the system doesn't reset the daily caps
+*/
+
+// longest single run allowed for a valve in seconds, 0 if unlimited
+func (v *Valve) maxRunDuration(c *Config) int {
+	if v.MaxRunDuration > 0 {
+		return v.MaxRunDuration
+	}
+	return c.MaxRunDuration
+}
+
+// smaller of a and a positive limit
+func capDuration(a int, limit int) int {
+	if limit > 0 && a > limit {
+		return limit
+	}
+	return a
+}
+
+// trim a run to the configured limits and reserve its runtime against today's allowance.
+// returns the limit the run was truncated by, if any, or an error if the run is refused outright
+func (m *RunManager) reserveRuntime(r *Run) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	today := time.Now().Format("2006-01-02")
+	if m.usageDay != today {
+		m.resetUsage(today)
+	}
+
+	requested := r.Duration
+	allowed := capDuration(requested, r.Valve.maxRunDuration(m.c))
+	reason := "max run duration"
+	if r.Valve.MaxDailyRuntime > 0 && allowed > r.Valve.MaxDailyRuntime-m.usage[r.Valve.ID] {
+		allowed = r.Valve.MaxDailyRuntime - m.usage[r.Valve.ID]
+		reason = "valve daily runtime limit"
+	}
+	if m.c.MaxDailyRuntime > 0 && allowed > m.c.MaxDailyRuntime-m.usageTotal {
+		allowed = m.c.MaxDailyRuntime - m.usageTotal
+		reason = "global daily runtime limit"
+	}
+
+	if allowed <= 0 {
+		return "", fmt.Errorf("refused run of %vs on valve %v (%v), %v reached", requested, r.Valve.ID, r.Valve.Name, reason)
+	}
+	m.usage[r.Valve.ID] += allowed
+	m.usageTotal += allowed
+	m.saveUsage()
+	r.usageDay = today
+	if allowed < requested {
+		r.Duration = allowed
+		return reason, nil
+	}
+	return "", nil
+}
+
+// give back reserved runtime that a run didn't use, e.g. when it was cancelled
+func (m *RunManager) returnRuntime(r *Run, unused int) {
+	if unused <= 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// allowance has already been reset if the day rolled over
+	if m.usageDay != r.usageDay {
+		return
+	}
+	m.usage[r.Valve.ID] -= unused
+	m.usageTotal -= unused
+	m.saveUsage()
+}
+
+// start counting usage for today, carrying on from the state file if it has today's usage.
+// caller must hold the lock
+func (m *RunManager) resetUsage(today string) {
+	m.usageDay = today
+	m.usage = make(map[string]int)
+	m.usageTotal = 0
+	if m.c.State == nil {
+		return
+	}
+	sd := m.c.State.current()
+	if sd.UsageDay == today {
+		maps.Copy(m.usage, sd.Usage)
+		m.usageTotal = sd.UsageTotal
+	}
+}
+
+// record today's usage in the state file, if configured, caller must hold the lock
+func (m *RunManager) saveUsage() {
+	if m.c.State == nil {
+		return
+	}
+	err := m.c.State.update(func(sd *StateData) {
+		sd.UsageDay = m.usageDay
+		sd.Usage = maps.Clone(m.usage)
+		sd.UsageTotal = m.usageTotal
+	})
+	if err != nil {
+		logerr := LogError(m.c, fmt.Errorf("could not save daily runtime: %v", err))
+		if logerr != nil {
+			log.Printf("could not log error: %v", logerr)
+		}
+	}
+}
+
+// seconds of runtime used today by a valve, or by all valves if valveID is empty
+func (m *RunManager) RuntimeToday(valveID string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	today := time.Now().Format("2006-01-02")
+	if m.usageDay != today {
+		m.resetUsage(today)
+	}
+	if valveID == "" {
+		return m.usageTotal
+	}
+	return m.usage[valveID]
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestReserveRuntime(t *testing.T) {
+	c := testRunConfig(t, "1", "2")
+	c.MaxRunDuration = 100
+	c.MaxDailyRuntime = 250
+	c.Valves[0].MaxDailyRuntime = 150
+	m := NewRunManager(c)
+
+	// single run cap
+	r := &Run{Valve: c.Valves[0], Duration: 7500}
+	limit, err := m.reserveRuntime(r)
+	if err != nil || limit == "" || r.Duration != 100 {
+		t.Errorf("expected run to be truncated to 100s, got %vs (%q, %v)", r.Duration, limit, err)
+	}
+
+	// valve daily cap, 100s already used
+	r = &Run{Valve: c.Valves[0], Duration: 75}
+	limit, err = m.reserveRuntime(r)
+	if err != nil || limit == "" || r.Duration != 50 {
+		t.Errorf("expected run to be truncated to 50s, got %vs (%q, %v)", r.Duration, limit, err)
+	}
+	r = &Run{Valve: c.Valves[0], Duration: 75}
+	_, err = m.reserveRuntime(r)
+	if err == nil {
+		t.Error("expected run to be refused once valve daily cap is used up")
+	}
+
+	// global daily cap, 150s already used
+	r = &Run{Valve: c.Valves[1], Duration: 60}
+	limit, err = m.reserveRuntime(r)
+	if err != nil || limit != "" || r.Duration != 60 {
+		t.Errorf("expected run to be allowed in full, got %vs (%q, %v)", r.Duration, limit, err)
+	}
+	r = &Run{Valve: c.Valves[1], Duration: 60}
+	limit, err = m.reserveRuntime(r)
+	if err != nil || limit == "" || r.Duration != 40 {
+		t.Errorf("expected run to be truncated to 40s, got %vs (%q, %v)", r.Duration, limit, err)
+	}
+	if m.RuntimeToday("") != 250 {
+		t.Errorf("expected 250s used today, got %v", m.RuntimeToday(""))
+	}
+
+	// unused runtime is given back
+	m.returnRuntime(r, 40)
+	if m.RuntimeToday("2") != 60 {
+		t.Errorf("expected 60s used by valve 2, got %v", m.RuntimeToday("2"))
+	}
+}
+
+func TestRuntimeSurvivesRestart(t *testing.T) {
+	c := testRunConfig(t, "1")
+	c.Valves[0].MaxDailyRuntime = 100
+	path := filepath.Join(t.TempDir(), "state.json")
+	st, err := LoadState(path)
+	if err != nil {
+		t.Fatalf("could not load state: %v", err)
+	}
+	c.State = st
+	m := NewRunManager(c)
+	_, err = m.reserveRuntime(&Run{Valve: c.Valves[0], Duration: 60})
+	if err != nil {
+		t.Fatalf("could not reserve runtime: %v", err)
+	}
+
+	// a restart picks up today's usage from the state file
+	c.State, err = LoadState(path)
+	if err != nil {
+		t.Fatalf("could not load state: %v", err)
+	}
+	m = NewRunManager(c)
+	if m.RuntimeToday("1") != 60 {
+		t.Errorf("expected 60s used today after restart, got %v", m.RuntimeToday("1"))
+	}
+	r := &Run{Valve: c.Valves[0], Duration: 60}
+	limit, err := m.reserveRuntime(r)
+	if err != nil || limit == "" || r.Duration != 40 {
+		t.Errorf("expected run to be truncated to 40s after restart, got %vs (%q, %v)", r.Duration, limit, err)
+	}
+}
+
+func TestRunRefusedByLimit(t *testing.T) {
+	c := testRunConfig(t, "1")
+	c.Valves[0].MaxDailyRuntime = 1
+	c.EventLogFile = t.TempDir() + "/events.log"
+	m := NewRunManager(c)
+	var finished []*Run
+	m.OnFinish = func(r *Run) {
+		finished = append(finished, r)
+	}
+
+	for i := 0; i < 2; i++ {
+		err := m.Enqueue(&Run{Valve: c.Valves[0], Duration: 1})
+		if err != nil {
+			t.Fatalf("could not queue run: %v", err)
+		}
+		m.Wait()
+	}
+	if len(finished) != 2 {
+		t.Fatalf("expected 2 finished runs, got %v", len(finished))
+	}
+	if finished[0].Err != nil {
+		t.Errorf("expected first run to succeed, got %v", finished[0].Err)
+	}
+	if finished[1].Err == nil || !finished[1].Started.IsZero() {
+		t.Error("expected second run to be refused without opening the valve")
+	}
+}
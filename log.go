@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gregdel/pushover"
@@ -24,6 +25,9 @@ func (le *LogEntry) String() string {
 func FormatEventMessage(cw *WeatherData, duration string, valve string, name string, skip bool) string {
 	if cw == nil {
 		return fmt.Sprintf("Water on Valve %v (%v) Event: %v", valve, name, duration)
+	} else if cw.Current == nil {
+		// rain gauge only, see GaugeWeather
+		return fmt.Sprintf("Valve: %v (%v) || Lookback Precip: %vmm || Water Duration: %vs", valve, name, cw.PastPrecip, duration)
 	} else {
 		msg := fmt.Sprintf("Valve: %v (%v) || Temp: %v || Humidity: %v || Condition: %v || Lookahead Precip: %vmm || Lookback Precip: %vmm || Water Duration: %vs", valve, name, cw.Current.Temp, cw.Current.Humidity, cw.Current.Condition.Text, cw.FuturePrecip, cw.PastPrecip, duration)
 		return msg
@@ -46,19 +50,107 @@ func (v *Valve) LogEvent(c *Config, wd *WeatherData, duration string, skip bool)
 			Message:   FormatEventMessage(wd, duration, v.ID, v.Name, skip),
 		}
 	}
-	if !c.UseDBLog {
+	var msg string
+	if wd != nil {
+		msg = FormatEventMessage(wd, duration, v.ID, v.Name, skip)
+	} else {
+		msg = le.String()
+	}
+	return WriteEvent(c, &le, msg)
+}
+
+// log a finished watering run, timestamped with when the valve actually opened
+func LogRun(c *Config, r *Run) error {
+	duration := int(r.Finished.Sub(r.Started).Round(time.Second).Seconds())
+	if len(r.Cycles) > 1 {
+		// time spent soaking doesn't count
+		duration = r.Watered()
+	}
+	msg := FormatEventMessage(r.Weather, fmt.Sprintf("%v", duration), r.Valve.ID, r.Valve.Name, false)
+	if r.Percent > 0 {
+		msg += fmt.Sprintf(" || Seasonal: %.0f%% of %vs", r.Percent, r.Timepoint.Duration)
+	}
+	if r.Started.Sub(r.Queued) >= time.Second {
+		msg += fmt.Sprintf(" || Queued: %v", r.Queued.Format("15:04:05"))
+	}
+	if len(r.Cycles) > 1 {
+		cycles := make([]string, len(r.Cycles))
+		for i, cy := range r.Cycles {
+			cycles[i] = fmt.Sprintf("%v %vs", cy.Start.Format("15:04:05"), cy.Seconds)
+		}
+		msg += fmt.Sprintf(" || Cycles: %v", strings.Join(cycles, ", "))
+	}
+	if c.FlowMeter != nil {
+		msg += fmt.Sprintf(" || Volume: %.1fL", r.Litres)
+		if r.Volume > 0 {
+			msg += fmt.Sprintf(" of %.1fL", r.Volume)
+		}
+	}
+	msg += r.Sensors.String()
+	if r.Stopped != "" {
+		msg += fmt.Sprintf(" || Stopped: %v", r.Stopped)
+	}
+	le := LogEntry{
+		Type:      "event",
+		Timestamp: r.Started,
+		Message:   msg,
+	}
+	return WriteEvent(c, &le, le.String())
+}
+
+// log a timepoint that was skipped, along with the reason and the sensor readings behind the decision
+func (v *Valve) LogSkip(c *Config, wd *WeatherData, sd *SensorData, reason string) error {
+	le := LogEntry{
+		Type:      "skip",
+		Timestamp: time.Now(),
+		Message:   FormatEventMessage(wd, "N/A", v.ID, v.Name, true) + sd.String() + fmt.Sprintf(" || Reason: %v", reason),
+	}
+	return WriteEvent(c, &le, le.String())
+}
+
+// log a timepoint that was missed while the system wasn't running, optionally also sending a push notification
+func (v *Valve) LogMissed(c *Config, at time.Time, reason string, notify bool) error {
+	le := LogEntry{
+		Type:      "missed",
+		Timestamp: time.Now(),
+		Message:   fmt.Sprintf("Valve: %v (%v) || Missed: %v || Reason: %v", v.ID, v.Name, at.Format("2006-01-02 15:04"), reason),
+	}
+	return writeEventNotify(c, &le, notify)
+}
+
+// log a change to the system's state, optionally also sending a push notification
+func LogSystem(c *Config, msg string, notify bool) error {
+	le := LogEntry{
+		Type:      "system",
+		Timestamp: time.Now(),
+		Message:   msg,
+	}
+	return writeEventNotify(c, &le, notify)
+}
+
+// write an event, making sure it's also pushed when notify is set
+func writeEventNotify(c *Config, le *LogEntry, notify bool) error {
+	err := WriteEvent(c, le, le.String())
+	if err != nil {
+		return err
+	}
+	// events logged to file aren't pushed, so push here unless WriteEvent already did
+	if notify && !c.DBLogOn() && c.PushoverOn() {
+		return PushNotif(c, le)
+	}
+	return nil
+}
+
+// write event entry to the log location defined in config,
+// fileMsg is the line written when logging to file
+func WriteEvent(c *Config, le *LogEntry, fileMsg string) error {
+	if !c.DBLogOn() {
 		file, err := os.OpenFile(c.EventLogFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
 		if err != nil {
 			return fmt.Errorf("could not open event log file: %v", err)
 		}
 		defer file.Close()
-		var msg string
-		if wd != nil {
-			msg = FormatEventMessage(wd, duration, v.ID, v.Name, skip)
-		} else {
-			msg = le.String()
-		}
-		_, err = file.Write([]byte(msg + "\n"))
+		_, err = file.Write([]byte(fileMsg + "\n"))
 		if err != nil {
 			log.Println("could not log event")
 			return fmt.Errorf("could not log event to file: %v", err)
@@ -74,8 +166,8 @@ func (v *Valve) LogEvent(c *Config, wd *WeatherData, duration string, skip bool)
 			return fmt.Errorf("could not insert event into log db: %v", err)
 		}
 	}
-	if c.UsePushover {
-		err := PushNotif(c, &le)
+	if c.PushoverOn() {
+		err := PushNotif(c, le)
 		if err != nil {
 			return fmt.Errorf("could not send push notification: %v", err)
 		}
@@ -90,7 +182,7 @@ func LogError(c *Config, e error) error {
 		Timestamp: time.Now(),
 		Message:   fmt.Sprint(e),
 	}
-	if !c.UseDBLog {
+	if !c.DBLogOn() {
 		file, err := os.OpenFile(c.EventLogFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
 		if err != nil {
 			return fmt.Errorf("could not open error log file: %v", err)
@@ -106,7 +198,7 @@ func LogError(c *Config, e error) error {
 			return fmt.Errorf("could not insert error into log db: %v", err)
 		}
 	}
-	if c.UsePushover {
+	if c.PushoverOn() {
 		err := PushNotif(c, &le)
 		if err != nil {
 			return fmt.Errorf("could not send push notification: %v", err)
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"os"
 	"time"
 )
 
@@ -28,17 +30,129 @@ water during the secondary timepoint
 Without using weather data, the system essentially runs on a timer,
 with watering occuring at every primary timepoint, and none of the secondary timepoints
 
-The main routine is an infinite loop, where on each loop the time is checked.
-If we're currently in a timepoint as defined in the config,
-we'll check the weather if applicable and decide whether or not to water
+The main routine runs a scheduler that sleeps until the next timepoint as defined in the config.
+When a timepoint comes due we'll check the weather if applicable and decide whether or not to water,
+unless a rain delay has been set, see raindelay.go
 */
 
-func sleep(duration int) {
-	time.Sleep(time.Duration(duration) * time.Second)
+// check the weather and sensors for a timepoint that came due, and queue a run or log a skip
+func fireTimepoint(config *Config, runs *RunManager, v *Valve, tp *WaterTimepoint) {
+	// a rain delay skips everything without checking the weather, see raindelay.go
+	if config.RainDelayed(time.Now()) {
+		err := v.LogSkip(config, nil, nil, "rain delay")
+		if err != nil {
+			logerr := LogError(config, err)
+			if logerr != nil {
+				log.Printf("could not log error: %v", logerr)
+			}
+		}
+		return
+	}
+	_ = config.OnlineCheck()
+	weather, err := GetWeatherTimeline(config)
+	if err != nil {
+		logerr := LogError(config, fmt.Errorf("could not create weather timeline: %v", err))
+		if logerr != nil {
+			log.Printf("could not log error: %v\n", err)
+		}
+	}
+	if tp.Solar != "" {
+		err = CheckSolar(config, weather)
+		if err != nil {
+			logerr := LogError(config, err)
+			if logerr != nil {
+				log.Printf("could not log error: %v", logerr)
+			}
+		}
+	}
+	sensors, err := v.ReadSensors(config)
+	if err != nil {
+		logerr := LogError(config, err)
+		if logerr != nil {
+			log.Printf("could not log error: %v", logerr)
+		}
+	}
+	duration, volume, pct := v.SeasonalDuration(config, tp, time.Now())
+	if duration <= 0 && tp.Duration > 0 {
+		err = v.LogSkip(config, weather, sensors, fmt.Sprintf("seasonal adjust %.0f%%", pct))
+		if err != nil {
+			logerr := LogError(config, err)
+			if logerr != nil {
+				log.Printf("could not log error: %v", logerr)
+			}
+		}
+	} else if ShouldWater(config, weather, tp, sensors) {
+		// colliding timepoints are queued and run in order, the event is logged when the run finishes
+		cycle, soak := v.CycleSoak(tp)
+		r := &Run{
+			Valve:     v,
+			Timepoint: tp,
+			Duration:  duration,
+			Volume:    volume,
+			Weather:   weather,
+			Sensors:   sensors,
+			Cycle:     cycle,
+			Soak:      soak,
+		}
+		if v.seasonal(config) != nil {
+			r.Percent = pct
+		}
+		err = runs.Enqueue(r)
+		if err != nil {
+			logerr := LogError(config, fmt.Errorf("could not queue watering on valve %v (%v): %v", v.ID, v.Name, err))
+			if logerr != nil {
+				log.Printf("could not log error: %v\n", logerr)
+			}
+		}
+		// log when a timepoint is skipped due to weather or sensors
+	} else {
+		err = v.LogSkip(config, weather, sensors, SkipReason(config, weather, tp, sensors))
+		if err != nil {
+			logerr := LogError(config, err)
+			if logerr != nil {
+				log.Printf("could not log error: %v", logerr)
+			}
+		}
+	}
 }
 
+// handle a missed timepoint, according to its missed policy
+func missedTimepoint(config *Config, runs *RunManager, o Occurrence, reason string) {
+	v, tp := o.Valve, o.Timepoint
+	if tp.Missed == "run" {
+		fireTimepoint(config, runs, v, tp)
+		return
+	}
+	err := v.LogMissed(config, o.Time, reason, tp.Missed == "notify")
+	if err != nil {
+		logerr := LogError(config, err)
+		if logerr != nil {
+			log.Printf("could not log error: %v", logerr)
+		}
+	}
+}
+
+const configPath = "/home/shaefferg/code/go/src/github.com/gerpsh/irrigation-system/config.json"
+
 func main() {
-	config, err := ReadConfig("/home/shaefferg/code/go/src/github.com/gerpsh/irrigation-system/config.json")
+	// commands change the state of the running system and exit, see command.go
+	if len(os.Args) > 1 {
+		config, err := LoadConfig(configPath)
+		if err != nil {
+			log.Fatalf("could not read config: %v", err)
+		}
+		err = config.InitState()
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = RunCommand(config, os.Args[1:], os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	config, err := ReadConfig(configPath)
 	if err != nil {
 		log.Fatalf("could not read config: %v", err)
 	}
@@ -47,61 +161,101 @@ func main() {
 		log.Fatal(err)
 	}
 
-	log.Println("running...")
-	for {
-		waterTime := 0
-		// create nil pointer to weather data, fill it later if we're using weather
-		var weather *WeatherData
-		now := time.Now()
-		for _, v := range config.Valves {
-			if is, tp := v.IsWaterTimepoint(config, now); is {
-				_ = config.OnlineCheck()
-				weather, err = GetWeatherTimeline(config)
-				if err != nil {
-					logerr := LogError(config, fmt.Errorf("could not create weather timeline: %v", err))
-					if logerr != nil {
-						log.Printf("could not log error: %v\n", err)
-					}
-					// sleep for a minute to avoid constant retries if the weather api is down
-					sleep(60)
+	// waterings run in the background so schedules keep being checked while a valve is open
+	runs := NewRunManager(config)
+
+	// make sure nothing is left running from a previous crash, and that nothing
+	// is left running if we go down from here on
+	HandleShutdownSignals(config, runs)
+	defer RecoverValves(config)
+	err = config.CloseValves(false)
+	if err != nil {
+		log.Fatalf("could not close valves on startup: %v", err)
+	}
+	// an unreachable http relay switches itself off anyway, so it shouldn't stop every other zone from running
+	err = config.CloseValves(true)
+	if err != nil {
+		logerr := LogError(config, fmt.Errorf("could not close http valves on startup: %v", err))
+		if logerr != nil {
+			log.Printf("could not log error: %v", logerr)
+		}
+	}
+
+	runs.OnFinish = func(r *Run) {
+		// runs aborted before opening the valve are skips, other runs that never opened it are only errors
+		var err error
+		if !r.Started.IsZero() {
+			err = LogRun(config, r)
+		} else if r.Stopped != "" {
+			err = r.Valve.LogSkip(config, r.Weather, r.Sensors, r.Stopped)
+		}
+		if err != nil {
+			logerr := LogError(config, err)
+			if logerr != nil {
+				log.Printf("could not log error: %v", logerr)
+			}
+		}
+		if r.Err != nil && r.Stopped == "" {
+			logerr := LogError(config, fmt.Errorf("could not water on valve %v (%v): %v", r.Valve.ID, r.Valve.Name, r.Err))
+			if logerr != nil {
+				log.Printf("could not log error: %v", logerr)
+			}
+		}
+	}
+
+	if config.FlowMeter != nil {
+		go runs.MonitorFlow(context.Background())
+	}
+	if config.RainSensor != nil {
+		go func() {
+			defer RecoverValves(config)
+			config.RainSensor.Watch(context.Background(), func() {
+				runs.Abort("rain sensor tripped")
+			}, func(err error) {
+				logerr := LogError(config, err)
+				if logerr != nil {
+					log.Printf("could not log error: %v", logerr)
 				}
-				if ShouldWater(config, weather, tp) {
-					err = v.Water(config, tp.Duration)
-					if err != nil {
-						logerr := LogError(config, fmt.Errorf("could not water on valve %v (%v): %v", v.ID, v.Name, err))
-						if logerr != nil {
-							log.Printf("could not log error: %v\n", err)
-						}
-					}
-					waterTime += tp.Duration
-					err = v.LogEvent(config, weather, fmt.Sprintf("%v", tp.Duration), false)
-					if err != nil {
-						logerr := LogError(config, err)
-						if logerr != nil {
-							log.Printf("could not log error: %v", logerr)
-						}
-					}
-					// log when a timepoint is skipped due to weather
-				} else {
-					err = v.LogEvent(config, weather, "N/A", true)
-					if err != nil {
-						logerr := LogError(config, err)
-						if logerr != nil {
-							log.Printf("could not log error: %v", logerr)
-						}
-					}
-					// sleep for a minute to make sure that we don't stay in the timepoint after a skip,
-					// which would result in rapid retries
-					sleep(60)
+			})
+		}()
+	}
+
+	if config.RainGauge != nil {
+		go func() {
+			defer RecoverValves(config)
+			config.RainGauge.Record(context.Background(), func(err error) {
+				logerr := LogError(config, err)
+				if logerr != nil {
+					log.Printf("could not log error: %v", logerr)
 				}
-			}
+			})
+		}()
+	}
+
+	go config.WatchRainDelay(context.Background(), func(err error) {
+		logerr := LogError(config, err)
+		if logerr != nil {
+			log.Printf("could not log error: %v", logerr)
 		}
-		// if we're still meeting timepoint criteria after watering,
-		// wait until the minute has passed so we don't do multiple waters
-		// on a single valve
-		if waterTime > 0 && waterTime < 60 {
-			sleep(60 - waterTime)
+	})
+
+	scheduler := NewScheduler(config)
+	scheduler.Fire = func(o Occurrence) {
+		fireTimepoint(config, runs, o.Valve, o.Timepoint)
+	}
+	scheduler.Missed = func(o Occurrence, reason string) {
+		missedTimepoint(config, runs, o, reason)
+	}
+	scheduler.Skip = func(o Occurrence, reason string) {
+		err := o.Valve.LogSkip(config, nil, nil, reason)
+		if err != nil {
+			logerr := LogError(config, err)
+			if logerr != nil {
+				log.Printf("could not log error: %v", logerr)
+			}
 		}
-		time.Sleep(time.Second * time.Duration(1))
 	}
+
+	log.Println("running...")
+	scheduler.Run(context.Background())
 }
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+/*
+Master valve / pump relay sequencing.
+The master output opens LeadTime seconds before the first zone valve opens
+and closes LagTime seconds after the last zone valve closes. If another zone opens
+within the lag, e.g. the next run in the queue, the master just stays open.
+When the master output drives a pump, keep LagTime short (or 0) so the pump isn't
+left running against closed zone valves during long inter-zone delays
+*/
+
+// output that must be on whenever any zone valve is open, configured like a valve
+type MasterValve struct {
+	Valve
+	LeadTime int `json:"lead_time"` // seconds to open the master before a zone valve
+	LagTime  int `json:"lag_time"`  // seconds to keep the master open after the last zone valve closes
+}
+
+// open the master output if it isn't already, waiting out the lead time when it has to open.
+// every successful call must be paired with a releaseMaster once the zone valve is closed
+func (m *RunManager) acquireMaster(ctx context.Context) error {
+	master := m.c.Master
+	if master == nil {
+		return nil
+	}
+
+	m.masterMu.Lock()
+	if m.masterShut {
+		m.masterMu.Unlock()
+		return fmt.Errorf("master valve was shut by a flow alarm")
+	}
+	if m.masterTimer != nil {
+		m.masterTimer.Stop()
+		m.masterTimer = nil
+	}
+	m.masterUsers++
+	if !m.masterOpen {
+		err := master.Device.Open(&master.Valve)
+		if err != nil {
+			m.masterUsers--
+			_ = master.Device.Close(&master.Valve)
+			m.masterMu.Unlock()
+			return fmt.Errorf("could not open master valve: %v", err)
+		}
+		m.masterOpen = true
+		ready := make(chan struct{})
+		m.masterReady = ready
+		time.AfterFunc(time.Duration(master.LeadTime)*time.Second, func() {
+			close(ready)
+		})
+	}
+	ready := m.masterReady
+	m.masterMu.Unlock()
+
+	// wait out the lead time without the lock, so a flow alarm can still shut the master.
+	// zones arriving while the master is opening wait for the same lead time to end
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		m.masterMu.Lock()
+		defer m.masterMu.Unlock()
+		m.masterUsers--
+		m.closeMasterIfIdle()
+		return fmt.Errorf("cancelled while waiting for master valve: %v", ctx.Err())
+	}
+
+	m.masterMu.Lock()
+	defer m.masterMu.Unlock()
+	if m.masterShut {
+		m.masterUsers--
+		return fmt.Errorf("master valve was shut by a flow alarm")
+	}
+	return nil
+}
+
+// give up a zone's hold on the master output, closing it after the lag time if no other zone is open
+func (m *RunManager) releaseMaster() {
+	master := m.c.Master
+	if master == nil {
+		return
+	}
+
+	m.masterMu.Lock()
+	defer m.masterMu.Unlock()
+	m.masterUsers--
+	if m.masterUsers > 0 || m.masterTimer != nil {
+		return
+	}
+	m.masterTimer = time.AfterFunc(time.Duration(master.LagTime)*time.Second, func() {
+		m.masterMu.Lock()
+		defer m.masterMu.Unlock()
+		m.masterTimer = nil
+		m.closeMasterIfIdle()
+	})
+}
+
+// caller must hold masterMu
+func (m *RunManager) closeMasterIfIdle() {
+	if m.masterUsers > 0 || !m.masterOpen {
+		return
+	}
+	master := m.c.Master
+	err := master.Device.Close(&master.Valve)
+	if err != nil {
+		logerr := LogError(m.c, fmt.Errorf("could not close master valve: %v", err))
+		if logerr != nil {
+			log.Printf("could not log error: %v", logerr)
+		}
+		return
+	}
+	m.masterOpen = false
+}
+
+// check whether the master output is currently held open
+func (m *RunManager) MasterOpen() bool {
+	m.masterMu.Lock()
+	defer m.masterMu.Unlock()
+	return m.masterOpen
+}
+
+// close the master output straight away and keep it closed, used by flow alarms
+func (m *RunManager) ShutMaster() error {
+	master := m.c.Master
+	if master == nil {
+		return fmt.Errorf("no master valve configured")
+	}
+
+	m.masterMu.Lock()
+	defer m.masterMu.Unlock()
+	m.masterShut = true
+	if m.masterTimer != nil {
+		m.masterTimer.Stop()
+		m.masterTimer = nil
+	}
+	err := master.Device.Close(&master.Valve)
+	if err != nil {
+		return err
+	}
+	m.masterOpen = false
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMasterSequencing(t *testing.T) {
+	c := testRunConfig(t, "1", "2")
+	c.Master = &MasterValve{
+		Valve:    Valve{ID: "master", Name: "pump"},
+		LeadTime: 1,
+		LagTime:  1,
+	}
+	err := c.InitDrivers()
+	if err != nil {
+		t.Fatalf("could not init drivers: %v", err)
+	}
+	fake := c.Master.Device.(*FakeDriver)
+	m := NewRunManager(c)
+
+	for _, v := range c.Valves {
+		err = m.Enqueue(&Run{Valve: v, Duration: 1})
+		if err != nil {
+			t.Fatalf("could not queue run: %v", err)
+		}
+	}
+	m.Wait()
+	if !m.MasterOpen() {
+		t.Error("expected master to stay open during the lag time")
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if m.MasterOpen() {
+		t.Error("expected master to close after the lag time")
+	}
+
+	// master opens once before the first zone and closes once after the last,
+	// staying open while the queue moves to the next zone
+	trs := fake.Transitions()
+	expected := []ValveTransition{
+		{ValveID: "master", Open: true},
+		{ValveID: "1", Open: true},
+		{ValveID: "1", Open: false},
+		{ValveID: "2", Open: true},
+		{ValveID: "2", Open: false},
+		{ValveID: "master", Open: false},
+	}
+	if len(trs) != len(expected) {
+		t.Fatalf("expected %v transitions, got %+v", len(expected), trs)
+	}
+	for i, e := range expected {
+		if trs[i].ValveID != e.ValveID || trs[i].Open != e.Open {
+			t.Errorf("transition %v: expected %+v, got %+v", i, e, trs[i])
+		}
+	}
+	if lead := trs[1].Time.Sub(trs[0].Time); lead < time.Second {
+		t.Errorf("expected zone to open at least 1s after master, got %v", lead)
+	}
+	if lag := trs[5].Time.Sub(trs[4].Time); lag < time.Second {
+		t.Errorf("expected master to close at least 1s after last zone, got %v", lag)
+	}
+}
+
+func TestShutMasterDuringLeadTime(t *testing.T) {
+	c := testRunConfig(t, "1")
+	c.Master = &MasterValve{
+		Valve:    Valve{ID: "master", Name: "pump"},
+		LeadTime: 2,
+	}
+	err := c.InitDrivers()
+	if err != nil {
+		t.Fatalf("could not init drivers: %v", err)
+	}
+	m := NewRunManager(c)
+
+	acquired := make(chan error, 1)
+	go func() {
+		acquired <- m.acquireMaster(context.Background())
+	}()
+	for deadline := time.Now().Add(time.Second); !m.MasterOpen() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a flow alarm mustn't have to wait for the lead time to end
+	start := time.Now()
+	err = m.ShutMaster()
+	if err != nil {
+		t.Fatalf("could not shut master: %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("shutting the master waited %v for the lead time", d)
+	}
+	if m.MasterOpen() {
+		t.Error("expected master to be shut")
+	}
+	if <-acquired == nil {
+		t.Error("expected zone waiting on the lead time to fail once the master was shut")
+	}
+}
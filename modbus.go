@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+/*
+Valves on Modbus relay boards, each valve a coil on the board.
+The board is reached over Modbus TCP, or Modbus RTU on a serial device such as a usb rs485 adapter,
+as set in config.Modbus. Valves using the "modbus" driver give the board's Unit id and
+their Coil, or OpenPin and ClosePin as coils when latching.
+Only the two function codes the driver needs are implemented,
+read coils (0x01) and write single coil (0x05)
+*/
+
+const (
+	modbusReadCoils       = 0x01
+	modbusWriteSingleCoil = 0x05
+)
+
+type ModbusConfig struct {
+	Transport string `json:"transport"` // "tcp" (default) or "rtu"
+	Address   string `json:"address"`   // host:port of the board or gateway, for tcp
+	Device    string `json:"device"`    // serial device, for rtu, e.g. /dev/ttyUSB0
+	Baud      int    `json:"baud"`      // serial speed for rtu, defaults to 9600, 8N1
+	Timeout   int    `json:"timeout"`   // ms to wait for a response, defaults to 1000
+}
+
+func (mc *ModbusConfig) timeout() time.Duration {
+	if mc.Timeout <= 0 {
+		return time.Second
+	}
+	return time.Duration(mc.Timeout) * time.Millisecond
+}
+
+// sends a request pdu to a unit and returns the response pdu
+type ModbusTransport interface {
+	Send(unit byte, pdu []byte) ([]byte, error)
+}
+
+// turn an exception response into an error
+func modbusException(fc byte, resp []byte) error {
+	if len(resp) == 0 {
+		return fmt.Errorf("empty modbus response")
+	}
+	if resp[0] == fc|0x80 {
+		if len(resp) < 2 {
+			return fmt.Errorf("modbus exception on function %#x", fc)
+		}
+		return fmt.Errorf("modbus exception %#x on function %#x", resp[1], fc)
+	}
+	if resp[0] != fc {
+		return fmt.Errorf("modbus response for function %#x, expected %#x", resp[0], fc)
+	}
+	return nil
+}
+
+// modbus tcp client, connecting on first use and again after any error
+type ModbusTCP struct {
+	Address string
+	Timeout time.Duration
+	mu      sync.Mutex
+	conn    net.Conn
+	txID    uint16
+}
+
+func (t *ModbusTCP) Send(unit byte, pdu []byte) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// a connection left idle may have been dropped by the board, so retry once on a fresh one
+	reused := t.conn != nil
+	resp, err := t.send(unit, pdu)
+	if err != nil && reused {
+		resp, err = t.send(unit, pdu)
+	}
+	return resp, err
+}
+
+// caller must hold the lock
+func (t *ModbusTCP) send(unit byte, pdu []byte) ([]byte, error) {
+	if t.conn == nil {
+		conn, err := net.DialTimeout("tcp", t.Address, t.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to modbus device %v: %v", t.Address, err)
+		}
+		t.conn = conn
+	}
+	resp, err := t.exchange(unit, pdu)
+	if err != nil {
+		t.conn.Close()
+		t.conn = nil
+		return nil, fmt.Errorf("modbus request to %v failed: %v", t.Address, err)
+	}
+	return resp, nil
+}
+
+// write an mbap framed request and read its response, caller must hold the lock
+func (t *ModbusTCP) exchange(unit byte, pdu []byte) ([]byte, error) {
+	t.txID++
+	req := make([]byte, 7, 7+len(pdu))
+	binary.BigEndian.PutUint16(req[0:], t.txID)
+	binary.BigEndian.PutUint16(req[2:], 0)
+	binary.BigEndian.PutUint16(req[4:], uint16(len(pdu)+1))
+	req[6] = unit
+	req = append(req, pdu...)
+
+	err := t.conn.SetDeadline(time.Now().Add(t.Timeout))
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.conn.Write(req)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 7)
+	_, err = io.ReadFull(t.conn, header)
+	if err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint16(header[4:])
+	if length < 2 || length > 254 {
+		return nil, fmt.Errorf("bad modbus frame length %v", length)
+	}
+	resp := make([]byte, length-1)
+	_, err = io.ReadFull(t.conn, resp)
+	if err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint16(header[0:]) != t.txID || header[6] != unit {
+		return nil, fmt.Errorf("modbus response doesn't match request")
+	}
+	return resp, nil
+}
+
+// modbus rtu client on a serial port, opened on first use
+type ModbusRTU struct {
+	Device  string
+	Baud    int
+	Timeout time.Duration
+	mu      sync.Mutex
+	port    io.ReadWriter // set on first use, or directly in tests
+}
+
+// crc-16/modbus of a frame
+func modbusCRC(b []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, c := range b {
+		crc ^= uint16(c)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+func (t *ModbusRTU) Send(unit byte, pdu []byte) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.port == nil {
+		port, err := openSerial(t.Device, t.Baud, t.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		t.port = port
+	}
+
+	req := append([]byte{unit}, pdu...)
+	req = binary.LittleEndian.AppendUint16(req, modbusCRC(req))
+	_, err := t.port.Write(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not write modbus request: %v", err)
+	}
+
+	// the response length depends on the function, and whether it's an exception
+	resp := make([]byte, 3)
+	_, err = io.ReadFull(t.port, resp)
+	if err != nil {
+		return nil, fmt.Errorf("no modbus response from unit %v: %v", unit, err)
+	}
+	rest := 2
+	switch {
+	case resp[1]&0x80 != 0:
+	case resp[1] == modbusReadCoils:
+		rest += int(resp[2])
+	default:
+		rest += 3
+	}
+	more := make([]byte, rest)
+	_, err = io.ReadFull(t.port, more)
+	if err != nil {
+		return nil, fmt.Errorf("short modbus response from unit %v: %v", unit, err)
+	}
+	resp = append(resp, more...)
+	n := len(resp)
+	if modbusCRC(resp[:n-2]) != binary.LittleEndian.Uint16(resp[n-2:]) {
+		return nil, fmt.Errorf("bad crc in modbus response from unit %v", unit)
+	}
+	if resp[0] != unit {
+		return nil, fmt.Errorf("modbus response from unit %v, expected %v", resp[0], unit)
+	}
+	return resp[1 : n-2], nil
+}
+
+// raw serial port, reads give up after the timeout set in termios
+type serialPort struct {
+	fd int
+}
+
+func (p *serialPort) Read(b []byte) (int, error) {
+	n, err := syscall.Read(p.fd, b)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("timed out")
+	}
+	return n, nil
+}
+
+func (p *serialPort) Write(b []byte) (int, error) {
+	return syscall.Write(p.fd, b)
+}
+
+var serialBauds = map[int]uint32{
+	1200:   syscall.B1200,
+	2400:   syscall.B2400,
+	4800:   syscall.B4800,
+	9600:   syscall.B9600,
+	19200:  syscall.B19200,
+	38400:  syscall.B38400,
+	57600:  syscall.B57600,
+	115200: syscall.B115200,
+}
+
+// open a serial device in raw 8N1 mode
+func openSerial(device string, baud int, timeout time.Duration) (*serialPort, error) {
+	if baud == 0 {
+		baud = 9600
+	}
+	speed, ok := serialBauds[baud]
+	if !ok {
+		return nil, fmt.Errorf("unsupported baud rate %v", baud)
+	}
+	fd, err := syscall.Open(device, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not open serial device %v: %v", device, err)
+	}
+	// vtime is in tenths of a second, and a read returns as soon as any bytes arrive
+	vtime := timeout / (100 * time.Millisecond)
+	if vtime < 1 {
+		vtime = 1
+	}
+	if vtime > 255 {
+		vtime = 255
+	}
+	tio := syscall.Termios{
+		Cflag:  speed | syscall.CS8 | syscall.CREAD | syscall.CLOCAL,
+		Ispeed: speed,
+		Ospeed: speed,
+	}
+	tio.Cc[syscall.VMIN] = 0
+	tio.Cc[syscall.VTIME] = uint8(vtime)
+	err = ioctl(fd, syscall.TCSETS, unsafe.Pointer(&tio))
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("could not configure serial device %v: %v", device, err)
+	}
+	return &serialPort{fd: fd}, nil
+}
+
+// drives valves that are coils on modbus relay boards
+type ModbusDriver struct {
+	Transport ModbusTransport
+	mu        sync.Mutex
+	latched   latchState
+}
+
+func NewModbusDriver(mc *ModbusConfig) (*ModbusDriver, error) {
+	if mc == nil {
+		return nil, fmt.Errorf("the modbus driver needs a modbus section in config")
+	}
+	d := &ModbusDriver{latched: make(latchState)}
+	switch mc.Transport {
+	case "", "tcp":
+		d.Transport = &ModbusTCP{Address: mc.Address, Timeout: mc.timeout()}
+	case "rtu":
+		d.Transport = &ModbusRTU{Device: mc.Device, Baud: mc.Baud, Timeout: mc.timeout()}
+	default:
+		return nil, fmt.Errorf("unknown modbus transport %q", mc.Transport)
+	}
+	return d, nil
+}
+
+// unit id of the valve's board, 1 unless set
+func modbusUnit(v *Valve) byte {
+	if v.Unit == 0 {
+		return 1
+	}
+	return byte(v.Unit)
+}
+
+// switch a coil to the valve's active or idle state
+func (d *ModbusDriver) set(v *Valve, coil int, active bool) error {
+	pdu := []byte{modbusWriteSingleCoil, byte(coil >> 8), byte(coil), 0x00, 0x00}
+	if active != v.ActiveLow() {
+		pdu[3] = 0xff
+	}
+	resp, err := d.Transport.Send(modbusUnit(v), pdu)
+	if err != nil {
+		return err
+	}
+	err = modbusException(modbusWriteSingleCoil, resp)
+	if err != nil {
+		return fmt.Errorf("could not write coil %v: %v", coil, err)
+	}
+	return nil
+}
+
+func (d *ModbusDriver) drive(v *Valve, open bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.latched.drive(v, v.Coil, open, func(coil int, active bool) error {
+		return d.set(v, coil, active)
+	})
+}
+
+func (d *ModbusDriver) Open(v *Valve) error {
+	return d.drive(v, true)
+}
+
+func (d *ModbusDriver) Close(v *Valve) error {
+	return d.drive(v, false)
+}
+
+// reads the coil back from the board, see latchState for latching valves
+func (d *ModbusDriver) IsOpen(v *Valve) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if v.Latching {
+		return d.latched[v.ID], nil
+	}
+	resp, err := d.Transport.Send(modbusUnit(v), []byte{modbusReadCoils, byte(v.Coil >> 8), byte(v.Coil), 0x00, 0x01})
+	if err != nil {
+		return false, err
+	}
+	err = modbusException(modbusReadCoils, resp)
+	if err == nil && (len(resp) < 3 || resp[1] < 1) {
+		err = errors.New("short read coils response")
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not read coil %v: %v", v.Coil, err)
+	}
+	return (resp[2]&1 != 0) != v.ActiveLow(), nil
+}
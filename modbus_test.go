@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// in-process modbus tcp server with 16 coils, standing in for a relay board
+type fakeModbusServer struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	coils [16]bool
+	conns int
+}
+
+func newFakeModbusServer(t *testing.T) *fakeModbusServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	s := &fakeModbusServer{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeModbusServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		header := make([]byte, 7)
+		_, err := io.ReadFull(conn, header)
+		if err != nil {
+			return
+		}
+		pdu := make([]byte, binary.BigEndian.Uint16(header[4:])-1)
+		_, err = io.ReadFull(conn, pdu)
+		if err != nil {
+			return
+		}
+		resp := s.handle(pdu)
+		binary.BigEndian.PutUint16(header[4:], uint16(len(resp)+1))
+		conn.Write(append(header, resp...))
+	}
+}
+
+func (s *fakeModbusServer) handle(pdu []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addr := int(binary.BigEndian.Uint16(pdu[1:]))
+	if addr >= len(s.coils) {
+		return []byte{pdu[0] | 0x80, 0x02}
+	}
+	switch pdu[0] {
+	case modbusReadCoils:
+		var b byte
+		if s.coils[addr] {
+			b = 1
+		}
+		return []byte{modbusReadCoils, 1, b}
+	case modbusWriteSingleCoil:
+		s.coils[addr] = pdu[3] == 0xff
+		return pdu
+	}
+	return []byte{pdu[0] | 0x80, 0x01}
+}
+
+func (s *fakeModbusServer) coil(n int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.coils[n]
+}
+
+func TestModbusDriverTCP(t *testing.T) {
+	s := newFakeModbusServer(t)
+	d, err := NewModbusDriver(&ModbusConfig{Address: s.ln.Addr().String()})
+	if err != nil {
+		t.Fatalf("could not create driver: %v", err)
+	}
+	v1 := &Valve{ID: "1", Coil: 3}
+	v2 := &Valve{ID: "2", Coil: 4, Polarity: "active_low"}
+
+	err = d.Open(v1)
+	if err != nil {
+		t.Fatalf("could not open valve: %v", err)
+	}
+	err = d.Close(v2)
+	if err != nil {
+		t.Fatalf("could not close valve: %v", err)
+	}
+	if !s.coil(3) || !s.coil(4) {
+		t.Errorf("expected coils 3 and 4 on, got %v %v", s.coil(3), s.coil(4))
+	}
+	open, err := d.IsOpen(v1)
+	if err != nil || !open {
+		t.Errorf("expected valve 1 to be open, got %v (%v)", open, err)
+	}
+	open, err = d.IsOpen(v2)
+	if err != nil || open {
+		t.Errorf("expected valve 2 to be closed, got %v (%v)", open, err)
+	}
+
+	err = d.Close(v1)
+	if err != nil {
+		t.Fatalf("could not close valve: %v", err)
+	}
+	if s.coil(3) {
+		t.Error("expected coil 3 off")
+	}
+	if d.Open(&Valve{ID: "3", Coil: 20}) == nil {
+		t.Error("expected exception for coil out of range")
+	}
+}
+
+func TestModbusTCPReconnect(t *testing.T) {
+	s := newFakeModbusServer(t)
+	tr := &ModbusTCP{Address: s.ln.Addr().String(), Timeout: time.Second}
+	d := &ModbusDriver{Transport: tr, latched: make(latchState)}
+	v := &Valve{ID: "1", Coil: 0}
+
+	err := d.Open(v)
+	if err != nil {
+		t.Fatalf("could not open valve: %v", err)
+	}
+	// the board dropping the connection shouldn't fail the next request
+	tr.conn.Close()
+	err = d.Close(v)
+	if err != nil {
+		t.Fatalf("could not close valve after reconnect: %v", err)
+	}
+	s.mu.Lock()
+	conns := s.conns
+	s.mu.Unlock()
+	if conns != 2 {
+		t.Errorf("expected 2 connections, got %v", conns)
+	}
+}
+
+func TestModbusCRC(t *testing.T) {
+	// write single coil 0 on, unit 1, from the modbus over serial line spec examples
+	crc := modbusCRC([]byte{0x01, 0x05, 0x00, 0x00, 0xff, 0x00})
+	if crc != 0x3a8c {
+		t.Errorf("expected crc 0x3a8c, got %#x", crc)
+	}
+}
+
+// serial port stand-in that answers every request with a canned response
+type fakeSerial struct {
+	written bytes.Buffer
+	resp    bytes.Buffer
+}
+
+func (p *fakeSerial) Write(b []byte) (int, error) {
+	return p.written.Write(b)
+}
+
+func (p *fakeSerial) Read(b []byte) (int, error) {
+	return p.resp.Read(b)
+}
+
+func TestModbusRTU(t *testing.T) {
+	port := &fakeSerial{}
+	tr := &ModbusRTU{port: port}
+	frame := []byte{0x02, 0x01, 0x01, 0x01}
+	port.resp.Write(binary.LittleEndian.AppendUint16(frame, modbusCRC(frame)))
+
+	resp, err := tr.Send(2, []byte{modbusReadCoils, 0x00, 0x07, 0x00, 0x01})
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	if !bytes.Equal(resp, []byte{0x01, 0x01, 0x01}) {
+		t.Errorf("unexpected response pdu %x", resp)
+	}
+	req := port.written.Bytes()
+	if !bytes.Equal(req[:6], []byte{0x02, 0x01, 0x00, 0x07, 0x00, 0x01}) || modbusCRC(req[:6]) != binary.LittleEndian.Uint16(req[6:]) {
+		t.Errorf("unexpected request frame %x", req)
+	}
+
+	// corrupted crc
+	port.resp.Write([]byte{0x02, 0x01, 0x01, 0x01, 0x00, 0x00})
+	_, err = tr.Send(2, []byte{modbusReadCoils, 0x00, 0x07, 0x00, 0x01})
+	if err == nil {
+		t.Error("expected crc error")
+	}
+}
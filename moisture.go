@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+/*
+Capacitive soil moisture probes read through an MCP3008 ADC on a spidev device.
+Each valve can have a probe on one of the ADC's channels, calibrated with the raw
+readings it gives in dry air and in water. Capacitive probes read lower the wetter they are
+*/
+
+// analog to digital converter with numbered input channels
+type ADC interface {
+	ReadChannel(ch int) (int, error)
+}
+
+type MoistureADC struct {
+	Device  string `json:"device"`   // spidev device the MCP3008 is on, e.g. /dev/spidev0.0
+	SpeedHz int    `json:"speed_hz"` // spi clock, defaults to 1MHz
+	ADC     ADC    `json:"-"`        // set by InitMoisture, or directly in tests
+}
+
+// per-valve moisture probe, thresholds are percent, 0 disables a threshold
+type MoistureProbe struct {
+	Channel    int     `json:"channel"`     // adc channel (0-7)
+	Dry        int     `json:"dry"`         // raw reading with the probe in dry air
+	Wet        int     `json:"wet"`         // raw reading with the probe in water
+	SkipAbove  float32 `json:"skip_above"`  // skip primary timepoints when moisture is above this
+	WaterBelow float32 `json:"water_below"` // fire secondary timepoints when moisture is below this
+}
+
+// convert a raw reading to percent using the probe's calibration, clamped to 0-100
+func (p *MoistureProbe) Percent(raw int) float32 {
+	if p.Dry == p.Wet {
+		return 0
+	}
+	pct := float32(p.Dry-raw) / float32(p.Dry-p.Wet) * 100
+	if pct < 0 {
+		return 0
+	}
+	if pct > 100 {
+		return 100
+	}
+	return pct
+}
+
+// set up the adc for moisture probes, if configured
+func (c *Config) InitMoisture() error {
+	if c.MoistureADC == nil || c.MoistureADC.ADC != nil {
+		return nil
+	}
+	speed := c.MoistureADC.SpeedHz
+	if speed <= 0 {
+		speed = 1000000
+	}
+	c.MoistureADC.ADC = &MCP3008{Device: c.MoistureADC.Device, SpeedHz: uint32(speed)}
+	return nil
+}
+
+// struct spi_ioc_transfer from include/uapi/linux/spi/spidev.h
+type spiIocTransfer struct {
+	TxBuf          uint64
+	RxBuf          uint64
+	Len            uint32
+	SpeedHz        uint32
+	DelayUsecs     uint16
+	BitsPerWord    uint8
+	CsChange       uint8
+	TxNbits        uint8
+	RxNbits        uint8
+	WordDelayUsecs uint8
+	Pad            uint8
+}
+
+// SPI_IOC_MESSAGE(1), _IOW('k', 0, struct spi_ioc_transfer)
+var spiIocMessage1 = (1 << 30) | (unsafe.Sizeof(spiIocTransfer{}) << 16) | ('k' << 8)
+
+// 10-bit, 8 channel SPI ADC
+type MCP3008 struct {
+	Device  string
+	SpeedHz uint32
+	mu      sync.Mutex
+}
+
+// single-ended read of a channel, 0-1023
+func (a *MCP3008) ReadChannel(ch int) (int, error) {
+	if ch < 0 || ch > 7 {
+		return 0, fmt.Errorf("mcp3008 channel %v out of range", ch)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	fd, err := syscall.Open(a.Device, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return 0, fmt.Errorf("could not open spi device %v: %v", a.Device, err)
+	}
+	defer syscall.Close(fd)
+
+	// start bit, then single-ended mode and channel, then clock out the result
+	tx := []byte{0x01, byte(0x08|ch) << 4, 0x00}
+	rx := make([]byte, len(tx))
+	tr := spiIocTransfer{
+		TxBuf:       uint64(uintptr(unsafe.Pointer(&tx[0]))),
+		RxBuf:       uint64(uintptr(unsafe.Pointer(&rx[0]))),
+		Len:         uint32(len(tx)),
+		SpeedHz:     a.SpeedHz,
+		BitsPerWord: 8,
+	}
+	err = ioctl(fd, spiIocMessage1, unsafe.Pointer(&tr))
+	// the buffers are only referenced through uintptrs in the transfer
+	runtime.KeepAlive(tx)
+	runtime.KeepAlive(rx)
+	if err != nil {
+		return 0, fmt.Errorf("could not read mcp3008 channel %v: %v", ch, err)
+	}
+	return int(rx[1]&0x03)<<8 | int(rx[2]), nil
+}
+
+// adc returning fixed raw values, for tests and for running without probes
+type FakeADC struct {
+	mu     sync.Mutex
+	Values map[int]int
+}
+
+func (a *FakeADC) Set(ch int, raw int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.Values == nil {
+		a.Values = make(map[int]int)
+	}
+	a.Values[ch] = raw
+}
+
+func (a *FakeADC) ReadChannel(ch int) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	raw, ok := a.Values[ch]
+	if !ok {
+		return 0, fmt.Errorf("no value for channel %v", ch)
+	}
+	return raw, nil
+}
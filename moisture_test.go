@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMoisturePercent(t *testing.T) {
+	p := &MoistureProbe{Dry: 800, Wet: 400}
+	cases := map[int]float32{
+		800: 0,
+		400: 100,
+		600: 50,
+		900: 0,
+		300: 100,
+	}
+	for raw, expected := range cases {
+		if pct := p.Percent(raw); pct != expected {
+			t.Errorf("expected %v%% for raw %v, got %v%%", expected, raw, pct)
+		}
+	}
+}
+
+func TestShouldWaterMoisture(t *testing.T) {
+	adc := &FakeADC{}
+	c := &Config{
+		RainThreshold: 12.0,
+		HotThreshold:  80,
+		MoistureADC:   &MoistureADC{ADC: adc},
+	}
+	v := &Valve{
+		ID:       "1",
+		Moisture: &MoistureProbe{Channel: 2, Dry: 800, Wet: 400, SkipAbove: 60, WaterBelow: 25},
+	}
+	primary := &WaterTimepoint{Type: "primary"}
+	secondary := &WaterTimepoint{Type: "secondary"}
+
+	// wet soil skips primary
+	adc.Set(2, 500)
+	sd, err := v.ReadSensors(c)
+	if err != nil {
+		t.Fatalf("could not read sensors: %v", err)
+	}
+	if ShouldWater(c, nil, primary, sd) {
+		t.Error("expected primary to be skipped with wet soil")
+	}
+	if ShouldWater(c, nil, secondary, sd) {
+		t.Error("expected secondary not to fire with wet soil")
+	}
+
+	// dry soil fires secondary, even without weather
+	adc.Set(2, 780)
+	sd, _ = v.ReadSensors(c)
+	if !ShouldWater(c, nil, primary, sd) {
+		t.Error("expected primary to water with dry soil")
+	}
+	if !ShouldWater(c, nil, secondary, sd) {
+		t.Error("expected secondary to fire with dry soil")
+	}
+
+	// but not if it's been rainy
+	rainy := &WeatherData{
+		Current:    &CurrentWeather{Temp: 70},
+		PastPrecip: 20,
+	}
+	if ShouldWater(c, rainy, secondary, sd) {
+		t.Error("expected secondary not to fire with dry soil when rainy")
+	}
+
+	// failed reads fall back to weather alone
+	adc.Values = nil
+	sd, err = v.ReadSensors(c)
+	if err == nil {
+		t.Error("expected error reading missing channel")
+	}
+	if !ShouldWater(c, nil, primary, sd) || ShouldWater(c, nil, secondary, sd) {
+		t.Error("expected default decisions without a moisture reading")
+	}
+}
+
+func TestSpiIocMessage(t *testing.T) {
+	if spiIocMessage1 != 0x40206B00 {
+		t.Errorf("expected SPI_IOC_MESSAGE(1) 0x40206B00, got %#x", spiIocMessage1)
+	}
+}
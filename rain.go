@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+Rain switch on a gpio input, e.g. a cheap normally-closed switch that opens when wet.
+It says whether it's raining right now, which the weather api can only guess at.
+While it's tripped no timepoint waters, and tripping it stops any run in progress.
+The line is polled and only counts as changed once it has held a new level for debounce ms
+*/
+
+// how often the rain switch line is read
+const rainPollInterval = 100 * time.Millisecond
+
+type RainSensor struct {
+	Chip     string   `json:"chip"`     // gpio chip the switch is wired to
+	Line     int      `json:"line"`     // line offset on chip
+	Polarity string   `json:"polarity"` // "active_high" (default) if the line reads high when raining, else "active_low"
+	Debounce int      `json:"debounce"` // ms the line must hold a level before it counts
+	Input    GPIOLine `json:"-"`        // set by InitRainSensor, or directly in tests
+
+	mu      sync.Mutex
+	raining bool      // debounced state
+	pending bool      // last raw state read
+	since   time.Time // when the raw state last changed
+}
+
+// request the rain switch line, if configured
+func (c *Config) InitRainSensor() error {
+	if c.RainSensor == nil || c.RainSensor.Input != nil {
+		return nil
+	}
+	l, err := RequestInputLine(c.RainSensor.Chip, c.RainSensor.Line)
+	if err != nil {
+		return fmt.Errorf("could not start rain sensor: %v", err)
+	}
+	c.RainSensor.Input = l
+	return nil
+}
+
+// debounced rain switch state, false if there's no rain sensor
+func (rs *RainSensor) Raining() bool {
+	if rs == nil {
+		return false
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.raining
+}
+
+// read the line and update the debounced state, returns true if the sensor just tripped
+func (rs *RainSensor) Poll(now time.Time) (bool, error) {
+	val, err := rs.Input.Value()
+	if err != nil {
+		return false, fmt.Errorf("could not read rain sensor: %v", err)
+	}
+	raw := val == 1
+	if rs.Polarity == "active_low" {
+		raw = !raw
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if raw != rs.pending {
+		rs.pending = raw
+		rs.since = now
+	}
+	if raw == rs.raining || now.Sub(rs.since) < time.Duration(rs.Debounce)*time.Millisecond {
+		return false, nil
+	}
+	rs.raining = raw
+	return raw, nil
+}
+
+// poll the rain switch until ctx is done, calling onTrip whenever it starts raining
+func (rs *RainSensor) Watch(ctx context.Context, onTrip func(), onError func(error)) {
+	ticker := time.NewTicker(rainPollInterval)
+	defer ticker.Stop()
+	var lastErr error
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			tripped, err := rs.Poll(now)
+			// only report errors once until the sensor reads again
+			if err != nil && lastErr == nil {
+				onError(err)
+			}
+			lastErr = err
+			if tripped {
+				onTrip()
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRainSensorDebounce(t *testing.T) {
+	line := &fakeLine{}
+	rs := &RainSensor{Polarity: "active_low", Debounce: 500, Input: line}
+	now := time.Now()
+	line.value = 1
+
+	tripped, err := rs.Poll(now)
+	if err != nil || tripped || rs.Raining() {
+		t.Fatalf("expected dry with line high and active_low polarity, got %v (%v)", rs.Raining(), err)
+	}
+
+	// a short blip doesn't count
+	line.value = 0
+	tripped, _ = rs.Poll(now.Add(100 * time.Millisecond))
+	line.value = 1
+	tripped2, _ := rs.Poll(now.Add(200 * time.Millisecond))
+	if tripped || tripped2 || rs.Raining() {
+		t.Error("expected short blip to be debounced")
+	}
+
+	// holding the level does
+	line.value = 0
+	_, _ = rs.Poll(now.Add(300 * time.Millisecond))
+	tripped, _ = rs.Poll(now.Add(600 * time.Millisecond))
+	if tripped {
+		t.Error("expected no trip before debounce period has passed")
+	}
+	tripped, _ = rs.Poll(now.Add(900 * time.Millisecond))
+	if !tripped || !rs.Raining() {
+		t.Error("expected sensor to trip after debounce period")
+	}
+	tripped, _ = rs.Poll(now.Add(1000 * time.Millisecond))
+	if tripped {
+		t.Error("expected trip to be reported once")
+	}
+}
+
+func TestRainSensorDecisions(t *testing.T) {
+	line := &fakeLine{value: 1}
+	c := &Config{
+		RainThreshold: 12.0,
+		HotThreshold:  80,
+		RainSensor:    &RainSensor{Input: line},
+	}
+	_, _ = c.RainSensor.Poll(time.Now())
+	hot := &WeatherData{Current: &CurrentWeather{Temp: 90}}
+
+	if ShouldWaterPrimary(c, nil) || ShouldWaterSecondary(c, hot) {
+		t.Error("expected no watering while rain sensor is tripped")
+	}
+	tp := &WaterTimepoint{Type: "primary"}
+	if ShouldWater(c, nil, tp, nil) {
+		t.Error("expected ShouldWater to skip while rain sensor is tripped")
+	}
+	if reason := SkipReason(c, nil, tp, nil); reason != "rain sensor tripped" {
+		t.Errorf("unexpected skip reason %q", reason)
+	}
+}
+
+func TestAbortRuns(t *testing.T) {
+	c := testRunConfig(t, "1", "2")
+	m := NewRunManager(c)
+	finished := make(chan *Run, 2)
+	m.OnFinish = func(r *Run) {
+		finished <- r
+	}
+
+	for _, v := range c.Valves {
+		err := m.Enqueue(&Run{Valve: v, Duration: 60})
+		if err != nil {
+			t.Fatalf("could not queue run: %v", err)
+		}
+	}
+	for deadline := time.Now().Add(2 * time.Second); !m.IsRunning("1") && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	m.Abort("rain sensor tripped")
+	m.Wait()
+
+	if len(finished) != 2 {
+		t.Fatalf("expected both runs to finish, got %v", len(finished))
+	}
+	for i := 0; i < 2; i++ {
+		r := <-finished
+		if r.Stopped != "rain sensor tripped" {
+			t.Errorf("expected run on valve %v to record stop reason, got %q", r.Valve.ID, r.Stopped)
+		}
+		if r.Valve.ID == "2" && !r.Started.IsZero() {
+			t.Error("expected queued run to never start")
+		}
+	}
+	for _, v := range c.Valves {
+		if open, _ := v.Device.IsOpen(v); open {
+			t.Errorf("expected valve %v to be closed after abort", v.ID)
+		}
+	}
+}
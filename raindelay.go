@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+/*
+Rain delay pauses all watering until a given time, e.g. for 48 hours when a storm is coming,
+without editing config.json. It's set, extended and cancelled with the rain-delay command,
+see command.go, and kept in the state file so it survives restarts.
+Timepoints that come due during the delay are logged as skips with the reason "rain delay",
+and runs already queued or soaking between cycles are stopped before their next cycle, see RunManager.water.
+The running system checks the delay every rainDelayCheckInterval and sends a notification
+when it expires, then clears it
+*/
+
+// how often the running system checks whether the rain delay has expired
+const rainDelayCheckInterval = time.Minute
+
+// end of the rain delay, zero if there is none
+func (st *State) RainDelay() time.Time {
+	return st.current().RainDelayUntil
+}
+
+// delay watering until until, replacing any delay already set
+func (st *State) SetRainDelay(until time.Time) error {
+	return st.update(func(sd *StateData) {
+		sd.RainDelayUntil = until
+	})
+}
+
+// push the end of the rain delay back by d, starting a delay from now if there isn't one.
+// returns the new end of the delay
+func (st *State) ExtendRainDelay(d time.Duration, now time.Time) (time.Time, error) {
+	var until time.Time
+	err := st.update(func(sd *StateData) {
+		from := sd.RainDelayUntil
+		if from.Before(now) {
+			from = now
+		}
+		until = from.Add(d)
+		sd.RainDelayUntil = until
+	})
+	return until, err
+}
+
+// whether watering is delayed at t
+func (c *Config) RainDelayed(t time.Time) bool {
+	if c.State == nil {
+		return false
+	}
+	return t.Before(c.State.RainDelay())
+}
+
+// clear a rain delay that ended at or before now, returning when it ended.
+// returns false if there's no delay or it hasn't ended yet
+func (st *State) expireRainDelay(now time.Time) (time.Time, bool, error) {
+	var until time.Time
+	var expired bool
+	err := st.update(func(sd *StateData) {
+		until = sd.RainDelayUntil
+		if until.IsZero() || until.After(now) {
+			return
+		}
+		sd.RainDelayUntil = time.Time{}
+		expired = true
+	})
+	return until, expired, err
+}
+
+// check for the rain delay expiring until ctx is done, logging it with a notification when it does
+func (c *Config) WatchRainDelay(ctx context.Context, onError func(error)) {
+	defer RecoverValves(c)
+	if c.State == nil {
+		return
+	}
+	ticker := time.NewTicker(rainDelayCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			err := c.checkRainDelay(now)
+			if err != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+func (c *Config) checkRainDelay(now time.Time) error {
+	// only read the file to begin with, it's checked again under the lock before clearing
+	until := c.State.RainDelay()
+	if until.IsZero() || until.After(now) {
+		return nil
+	}
+	until, expired, err := c.State.expireRainDelay(now)
+	if err != nil || !expired {
+		return err
+	}
+	return LogSystem(c, fmt.Sprintf("Rain delay expired || Until: %v", until.Format("2006-01-02 15:04")), true)
+}
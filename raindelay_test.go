@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRainDelayCommand(t *testing.T) {
+	dir := t.TempDir()
+	c := &Config{EventLogFile: filepath.Join(dir, "events.log"), StateFile: filepath.Join(dir, "state.json")}
+	err := c.InitState()
+	if err != nil {
+		t.Fatalf("could not load state: %v", err)
+	}
+
+	var out bytes.Buffer
+	err = RunCommand(c, []string{"rain-delay", "48"}, &out)
+	if err != nil {
+		t.Fatalf("could not set rain delay: %v", err)
+	}
+	now := time.Now()
+	if !c.RainDelayed(now.Add(47*time.Hour)) || c.RainDelayed(now.Add(49*time.Hour)) {
+		t.Errorf("expected a 48 hour delay, got one until %v", c.State.RainDelay())
+	}
+
+	// survives a restart
+	st, err := LoadState(c.StateFile)
+	if err != nil {
+		t.Fatalf("could not reload state: %v", err)
+	}
+	until := st.RainDelay()
+	if d := until.Sub(now); d < 47*time.Hour || d > 49*time.Hour {
+		t.Errorf("expected delay to be persisted, got %v", until)
+	}
+
+	err = RunCommand(c, []string{"rain-delay", "extend", "24"}, &out)
+	if err != nil {
+		t.Fatalf("could not extend rain delay: %v", err)
+	}
+	if !c.State.RainDelay().Equal(until.Add(24 * time.Hour)) {
+		t.Errorf("expected delay extended by 24 hours, got %v", c.State.RainDelay())
+	}
+
+	err = RunCommand(c, []string{"rain-delay", "cancel"}, &out)
+	if err != nil {
+		t.Fatalf("could not cancel rain delay: %v", err)
+	}
+	if c.RainDelayed(now) {
+		t.Error("expected no delay after cancelling")
+	}
+
+	for _, args := range [][]string{{"rain-delay"}, {"rain-delay", "soon"}, {"rain-delay", "-5"}, {"rain-delay", "extend"}} {
+		if RunCommand(c, args, &out) == nil {
+			t.Errorf("expected error for %v", args)
+		}
+	}
+
+	// extending without a delay starts one from now
+	until, err = c.State.ExtendRainDelay(time.Hour, now)
+	if err != nil || !until.Equal(now.Add(time.Hour)) {
+		t.Errorf("expected delay of an hour from now, got %v %v", until, err)
+	}
+}
+
+func TestRainDelayExpires(t *testing.T) {
+	dir := t.TempDir()
+	c := &Config{EventLogFile: filepath.Join(dir, "events.log"), StateFile: filepath.Join(dir, "state.json")}
+	err := c.InitState()
+	if err != nil {
+		t.Fatalf("could not load state: %v", err)
+	}
+	now := time.Date(2024, 6, 17, 7, 0, 0, 0, time.Local)
+	err = c.State.SetRainDelay(now.Add(2 * time.Hour))
+	if err != nil {
+		t.Fatalf("could not set rain delay: %v", err)
+	}
+
+	for _, at := range []time.Time{now.Add(time.Hour), now.Add(2 * time.Hour), now.Add(3 * time.Hour)} {
+		err = c.checkRainDelay(at)
+		if err != nil {
+			t.Fatalf("could not check rain delay: %v", err)
+		}
+	}
+	if !c.State.RainDelay().IsZero() {
+		t.Error("expected expired delay to be cleared")
+	}
+	b, _ := os.ReadFile(c.EventLogFile)
+	if n := strings.Count(string(b), "Rain delay expired || Until: 2024-06-17 09:00"); n != 1 {
+		t.Errorf("expected expiry to be logged once, got %v in %q", n, b)
+	}
+}
+
+func TestRainDelayStopsCycles(t *testing.T) {
+	c := testRunConfig(t, "1")
+	st, err := LoadState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatalf("could not load state: %v", err)
+	}
+	c.State = st
+	m := NewRunManager(c)
+	finished := make(chan *Run, 1)
+	m.OnFinish = func(r *Run) {
+		finished <- r
+	}
+
+	err = m.Enqueue(&Run{Valve: c.Valves[0], Duration: 3, Cycle: 1, Soak: 1})
+	if err != nil {
+		t.Fatalf("could not queue run: %v", err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	err = st.SetRainDelay(time.Now().Add(48 * time.Hour))
+	if err != nil {
+		t.Fatalf("could not set rain delay: %v", err)
+	}
+	m.Wait()
+
+	// the delay stops the run while it's soaking, its next cycle doesn't open the valve
+	r := <-finished
+	if r.Stopped != "rain delay" || len(r.Cycles) != 1 {
+		t.Errorf("expected run stopped by rain delay after 1 cycle, got %q with cycles %+v", r.Stopped, r.Cycles)
+	}
+}
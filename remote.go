@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Valves on wi-fi relays (ESPHome, Tasmota, Shelly and the like) switched over http.
+Valves using the "http" driver set a remote section with url templates for on, off and status.
+The on url must pass the relay an auto-off time through {seconds} or {ms}, e.g. for a Shelly
+http://10.0.0.7/relay/0?turn=on&timer={seconds}, so the relay switches itself off if it stops
+hearing from us. While a valve is open the on url is sent again every third of the auto-off time,
+so runs can be longer than the auto-off, but a lost network can't leave a zone running
+*/
+
+// wait between attempts at a failed request
+const remoteRetryDelay = 500 * time.Millisecond
+
+// per-valve wi-fi relay settings
+type RemoteRelay struct {
+	OnURL     string `json:"on_url"`     // url to switch the relay on, with {seconds} or {ms} for the auto-off time
+	OffURL    string `json:"off_url"`    // url to switch the relay off
+	StatusURL string `json:"status_url"` // optional url reporting the relay's state
+	StatusOn  string `json:"status_on"`  // text in the status response when the relay is on, e.g. "\"ison\":true"
+	AutoOff   int    `json:"auto_off"`   // seconds after which the relay switches itself off, required
+	Timeout   int    `json:"timeout"`    // ms to wait for each request, defaults to 5000
+	Retries   int    `json:"retries"`    // extra attempts at a failed request
+}
+
+// fill in the auto-off placeholders in a url template
+func (rr *RemoteRelay) expand(tmpl string) string {
+	return strings.NewReplacer(
+		"{seconds}", strconv.Itoa(rr.AutoOff),
+		"{ms}", strconv.Itoa(rr.AutoOff*1000),
+	).Replace(tmpl)
+}
+
+// state of one remote valve
+type remoteState struct {
+	mu   sync.Mutex // held while sending commands, so a refresh can't land after an off
+	on   bool
+	stop chan struct{} // closed to stop refreshing the on command
+}
+
+// drives valves on wi-fi relays over http
+type HTTPDriver struct {
+	c      *Config
+	mu     sync.Mutex
+	states map[string]*remoteState // keyed by valve id
+}
+
+func NewHTTPDriver(c *Config) *HTTPDriver {
+	return &HTTPDriver{
+		c:      c,
+		states: make(map[string]*remoteState),
+	}
+}
+
+func (d *HTTPDriver) state(v *Valve) *remoteState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	st, ok := d.states[v.ID]
+	if !ok {
+		st = &remoteState{}
+		d.states[v.ID] = st
+	}
+	return st
+}
+
+// get a url, retrying on errors and non-2xx responses, and return the body
+func (rr *RemoteRelay) get(url string) (string, error) {
+	timeout := time.Duration(rr.Timeout) * time.Millisecond
+	if rr.Timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	client := http.Client{Timeout: timeout}
+
+	var err error
+	for attempt := 0; attempt <= rr.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(remoteRetryDelay)
+		}
+		var resp *http.Response
+		resp, err = client.Get(url)
+		if err != nil {
+			continue
+		}
+		var body []byte
+		body, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			err = fmt.Errorf("status %v", resp.Status)
+			continue
+		}
+		return string(body), nil
+	}
+	return "", err
+}
+
+func (d *HTTPDriver) Open(v *Valve) error {
+	rr := v.Remote
+	if rr == nil {
+		return fmt.Errorf("valve %v has no remote relay configured", v.ID)
+	}
+	st := d.state(v)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	_, err := rr.get(rr.expand(rr.OnURL))
+	if err != nil {
+		return fmt.Errorf("could not switch on remote valve %v: %v", v.ID, err)
+	}
+	st.on = true
+	if st.stop == nil {
+		st.stop = make(chan struct{})
+		go d.refresh(v, st, st.stop)
+	}
+	return nil
+}
+
+// resend the on command until stopped, so the relay's auto-off doesn't end the run
+func (d *HTTPDriver) refresh(v *Valve, st *remoteState, stop chan struct{}) {
+	defer RecoverValves(d.c)
+	ticker := time.NewTicker(time.Duration(v.Remote.AutoOff) * time.Second / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		st.mu.Lock()
+		if !st.on {
+			st.mu.Unlock()
+			return
+		}
+		_, err := v.Remote.get(v.Remote.expand(v.Remote.OnURL))
+		st.mu.Unlock()
+		if err != nil {
+			logerr := LogError(d.c, fmt.Errorf("could not refresh remote valve %v (%v), it will switch off after %vs: %v", v.ID, v.Name, v.Remote.AutoOff, err))
+			if logerr != nil {
+				log.Printf("could not log error: %v", logerr)
+			}
+		}
+	}
+}
+
+func (d *HTTPDriver) Close(v *Valve) error {
+	rr := v.Remote
+	if rr == nil {
+		return fmt.Errorf("valve %v has no remote relay configured", v.ID)
+	}
+	st := d.state(v)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.on = false
+	if st.stop != nil {
+		close(st.stop)
+		st.stop = nil
+	}
+	_, err := rr.get(rr.expand(rr.OffURL))
+	if err != nil {
+		return fmt.Errorf("could not switch off remote valve %v, it will switch off after %vs: %v", v.ID, rr.AutoOff, err)
+	}
+	return nil
+}
+
+// asks the relay when there's a status url, otherwise reports the last command sent
+func (d *HTTPDriver) IsOpen(v *Valve) (bool, error) {
+	rr := v.Remote
+	if rr == nil {
+		return false, fmt.Errorf("valve %v has no remote relay configured", v.ID)
+	}
+	if rr.StatusURL == "" {
+		st := d.state(v)
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		return st.on, nil
+	}
+	body, err := rr.get(rr.expand(rr.StatusURL))
+	if err != nil {
+		return false, fmt.Errorf("could not get status of remote valve %v: %v", v.ID, err)
+	}
+	return strings.Contains(body, rr.StatusOn), nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// wi-fi relay stand-in, recording every request and failing the first few if asked
+type fakeRelay struct {
+	mu       sync.Mutex
+	on       bool
+	requests []string
+	failures int
+}
+
+func (f *fakeRelay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.URL.RequestURI())
+	if f.failures > 0 {
+		f.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	switch r.URL.Query().Get("turn") {
+	case "on":
+		f.on = true
+	case "off":
+		f.on = false
+	}
+	if f.on {
+		w.Write([]byte(`{"ison":true}`))
+	} else {
+		w.Write([]byte(`{"ison":false}`))
+	}
+}
+
+func (f *fakeRelay) count(uri string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, r := range f.requests {
+		if r == uri {
+			n++
+		}
+	}
+	return n
+}
+
+func testRemoteValve(t *testing.T, relay *fakeRelay, autoOff int) (*HTTPDriver, *Valve) {
+	srv := httptest.NewServer(relay)
+	t.Cleanup(srv.Close)
+	c := &Config{EventLogFile: filepath.Join(t.TempDir(), "events.log")}
+	v := &Valve{ID: "1", Name: "far bed", Remote: &RemoteRelay{
+		OnURL:     srv.URL + "/relay/0?turn=on&timer={seconds}",
+		OffURL:    srv.URL + "/relay/0?turn=off",
+		StatusURL: srv.URL + "/relay/0",
+		StatusOn:  `"ison":true`,
+		AutoOff:   autoOff,
+		Timeout:   1000,
+		Retries:   2,
+	}}
+	return NewHTTPDriver(c), v
+}
+
+func TestHTTPDriver(t *testing.T) {
+	relay := &fakeRelay{}
+	d, v := testRemoteValve(t, relay, 60)
+
+	err := d.Open(v)
+	if err != nil {
+		t.Fatalf("could not open valve: %v", err)
+	}
+	if relay.count("/relay/0?turn=on&timer=60") != 1 {
+		t.Errorf("expected on request with auto-off, got %v", relay.requests)
+	}
+	open, err := d.IsOpen(v)
+	if err != nil || !open {
+		t.Errorf("expected valve to be open, got %v (%v)", open, err)
+	}
+	err = d.Close(v)
+	if err != nil {
+		t.Fatalf("could not close valve: %v", err)
+	}
+	open, err = d.IsOpen(v)
+	if err != nil || open {
+		t.Errorf("expected valve to be closed, got %v (%v)", open, err)
+	}
+}
+
+func TestHTTPDriverRetries(t *testing.T) {
+	relay := &fakeRelay{failures: 2}
+	d, v := testRemoteValve(t, relay, 60)
+	err := d.Open(v)
+	if err != nil {
+		t.Fatalf("expected open to succeed on the last retry: %v", err)
+	}
+	d.Close(v)
+
+	relay.mu.Lock()
+	relay.failures = 3
+	relay.mu.Unlock()
+	if d.Open(v) == nil {
+		t.Error("expected error once retries run out")
+	}
+}
+
+func TestHTTPDriverRefresh(t *testing.T) {
+	relay := &fakeRelay{}
+	d, v := testRemoteValve(t, relay, 1)
+	on := "/relay/0?turn=on&timer=1"
+
+	err := d.Open(v)
+	if err != nil {
+		t.Fatalf("could not open valve: %v", err)
+	}
+	// a run longer than the auto-off keeps the relay on by resending the on command
+	time.Sleep(1200 * time.Millisecond)
+	if n := relay.count(on); n < 3 {
+		t.Errorf("expected on to be resent while open, got %v on requests", n)
+	}
+	err = d.Close(v)
+	if err != nil {
+		t.Fatalf("could not close valve: %v", err)
+	}
+	n := relay.count(on)
+	time.Sleep(700 * time.Millisecond)
+	if relay.count(on) != n {
+		t.Error("expected no on requests after close")
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// a single watering of one valve, executed in the background by a RunManager
+type Run struct {
+	Valve     *Valve
+	Timepoint *WaterTimepoint
+	Duration  int          // seconds to water
+	Weather   *WeatherData // weather used to decide on the run, for logging
+	Sensors   *SensorData  // local sensor readings used to decide on the run, for logging
+	Queued    time.Time
+	Started   time.Time
+	Finished  time.Time
+	Requested int     // seconds originally asked for, before runtime limits were applied
+	Volume    float32 // litres to water, if set Duration is the timeout
+	Litres    float32 // litres measured by the flow meter during the run
+	Err       error   // set if the run failed or was cancelled
+	Stopped   string  // why the run was stopped early or dropped from the queue, if it was aborted
+	Cycle     int     // longest single cycle in seconds, 0 to water the whole duration at once
+	Soak      int     // least seconds to wait between cycles
+	Cycles    []RunCycle
+	Percent   float64 // seasonal adjust percentage Duration and Volume were scaled by, 0 if not adjusted
+	cancel    context.CancelFunc
+	usageDay  string    // day the run's runtime was counted against, see limits.go
+	reserved  bool      // runtime has been reserved against today's limits
+	remaining int       // seconds left to water in later cycles
+	notBefore time.Time // earliest the next cycle may start, while soaking
+	opened    time.Time // when the valve opened for the current cycle
+}
+
+// one stretch of a run with the valve open, runs without cycle/soak have exactly one
+type RunCycle struct {
+	Start   time.Time
+	Seconds int
+}
+
+/*
+Executes runs as cancellable background jobs, so the main loop can keep checking
+schedules while a valve is open.
+
+Runs are queued and started in the order they were enqueued, with at most
+config.MaxConcurrentValves open at once. When a valve closes, the next queued run waits
+config.InterZoneDelay seconds before opening, so colliding timepoints run back to back
+instead of being missed.
+
+Runs with cycle/soak settings water in cycles of at most Cycle seconds. After each cycle
+the run goes to the back of the queue and waits at least Soak seconds, so other zones'
+cycles run in between. Volume runs always water in a single cycle.
+*/
+type RunManager struct {
+	c        *Config
+	ctx      context.Context
+	mu       sync.Mutex
+	queue    []*Run
+	running  map[string]*Run // keyed by valve id
+	lastEnd  time.Time       // when the last run finished, for the inter-zone delay
+	timer    *time.Timer     // pending dispatch after the inter-zone delay or a soak
+	timerAt  time.Time       // when timer fires
+	stopped  bool            // shutting down, no more runs start, see Stop
+	wg       sync.WaitGroup
+	OnStart  func(r *Run) // called from the run's goroutine just before the valve opens, after any master lead time
+	OnFinish func(r *Run) // called from the run's goroutine once the valve is closed
+
+	// runtime reserved today, see limits.go
+	usage      map[string]int // seconds keyed by valve id
+	usageTotal int            // seconds across all valves
+	usageDay   string         // day the usage counters are for
+
+	// flow monitoring state, see leak.go
+	baselines map[string]flowBaseline // keyed by valve id
+	alarms    map[string]bool         // active flow alarms
+
+	// master valve state, see master.go
+	masterMu    sync.Mutex
+	masterOpen  bool
+	masterUsers int           // number of zones holding the master open
+	masterTimer *time.Timer   // pending close after the lag time
+	masterReady chan struct{} // closed once the lead time after the master opened has passed
+	masterShut  bool          // shut by a flow alarm, refuse to open again
+}
+
+func NewRunManager(c *Config) *RunManager {
+	return &RunManager{
+		c:         c,
+		ctx:       context.Background(),
+		running:   make(map[string]*Run),
+		baselines: make(map[string]flowBaseline),
+		alarms:    make(map[string]bool),
+	}
+}
+
+func (m *RunManager) maxConcurrent() int {
+	if m.c.MaxConcurrentValves < 1 {
+		return 1
+	}
+	return m.c.MaxConcurrentValves
+}
+
+// add a run to the back of the queue, fails if the valve is already queued or running
+func (m *RunManager) Enqueue(r *Run) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopped {
+		return fmt.Errorf("not queueing valve %v (%v), shutting down", r.Valve.ID, r.Valve.Name)
+	}
+	if _, ok := m.running[r.Valve.ID]; ok {
+		return fmt.Errorf("valve %v (%v) is already running", r.Valve.ID, r.Valve.Name)
+	}
+	for _, q := range m.queue {
+		if q.Valve.ID == r.Valve.ID {
+			return fmt.Errorf("valve %v (%v) is already queued", r.Valve.ID, r.Valve.Name)
+		}
+	}
+
+	r.Queued = time.Now()
+	m.queue = append(m.queue, r)
+	m.wg.Add(1)
+	m.dispatch()
+	return nil
+}
+
+// start as many queued runs as limits allow, caller must hold the lock.
+// runs go in queue order, skipping runs still soaking between cycles
+func (m *RunManager) dispatch() {
+	if m.stopped {
+		return
+	}
+	for len(m.running) < m.maxConcurrent() {
+		now := time.Now()
+		next := -1
+		var wake time.Time
+		for i, q := range m.queue {
+			if !q.notBefore.After(now) {
+				next = i
+				break
+			}
+			if wake.IsZero() || q.notBefore.Before(wake) {
+				wake = q.notBefore
+			}
+		}
+		delayEnd := m.lastEnd.Add(time.Duration(m.c.InterZoneDelay) * time.Second)
+		if next >= 0 && delayEnd.After(now) {
+			next = -1
+			wake = delayEnd
+		}
+		if next < 0 {
+			if !wake.IsZero() {
+				m.wakeAt(wake)
+			}
+			return
+		}
+
+		r := m.queue[next]
+		m.queue = append(m.queue[:next], m.queue[next+1:]...)
+		var ctx context.Context
+		ctx, r.cancel = context.WithCancel(m.ctx)
+		m.running[r.Valve.ID] = r
+		go m.execute(ctx, r)
+	}
+}
+
+// make sure dispatch runs again by t, caller must hold the lock
+func (m *RunManager) wakeAt(t time.Time) {
+	if m.timer != nil {
+		if !m.timerAt.After(t) {
+			return
+		}
+		m.timer.Stop()
+	}
+	m.timerAt = t
+	m.timer = time.AfterFunc(time.Until(t), func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.timer = nil
+		m.dispatch()
+	})
+}
+
+// run one cycle of a run, then either send it back to the queue to soak or finish it
+func (m *RunManager) execute(ctx context.Context, r *Run) {
+	defer RecoverValves(m.c)
+
+	err := m.water(ctx, r)
+	now := time.Now()
+	r.cancel()
+
+	m.mu.Lock()
+	delete(m.running, r.Valve.ID)
+	m.lastEnd = now
+	again := err == nil && r.remaining > 0 && r.Stopped == "" && !m.stopped
+	if again {
+		r.opened = time.Time{}
+		r.notBefore = now.Add(time.Duration(r.Soak) * time.Second)
+		m.queue = append(m.queue, r)
+	}
+	m.dispatch()
+	m.mu.Unlock()
+	if again {
+		return
+	}
+	m.finish(r, err)
+}
+
+// wrap up a run that won't water any more, caller must not hold the lock
+func (m *RunManager) finish(r *Run, err error) {
+	defer m.wg.Done()
+	r.Err = err
+	r.Finished = time.Now()
+	if r.reserved {
+		m.returnRuntime(r, r.Duration-r.Watered())
+	}
+	if m.OnFinish != nil {
+		m.OnFinish(r)
+	}
+}
+
+// run a single cycle, applying runtime limits before the first one.
+// opens the valve with the master for the cycle's duration
+func (m *RunManager) water(ctx context.Context, r *Run) error {
+	// the system turned off, a blackout or a rain delay starting while the run was queued or soaking
+	// stops it before its next cycle
+	now := time.Now()
+	if reason := m.c.Blocked(now); reason != "" {
+		return m.stopBefore(r, reason)
+	}
+	if m.c.RainDelayed(now) {
+		return m.stopBefore(r, "rain delay")
+	}
+	if !r.reserved {
+		r.Requested = r.Duration
+		limit, err := m.reserveRuntime(r)
+		if err != nil {
+			return err
+		}
+		r.reserved = true
+		r.remaining = r.Duration
+		if limit != "" {
+			logerr := LogError(m.c, fmt.Errorf("truncated run on valve %v (%v) from %vs to %vs, %v", r.Valve.ID, r.Valve.Name, r.Requested, r.Duration, limit))
+			if logerr != nil {
+				log.Printf("could not log error: %v", logerr)
+			}
+		}
+	}
+	err := m.acquireMaster(ctx)
+	if err != nil {
+		return err
+	}
+	defer m.releaseMaster()
+
+	cycle := r.remaining
+	if r.Cycle > 0 && cycle > r.Cycle && r.Volume <= 0 {
+		cycle = r.Cycle
+	}
+	m.mu.Lock()
+	opened := time.Now()
+	if r.Started.IsZero() {
+		r.Started = opened
+	}
+	r.opened = opened
+	m.mu.Unlock()
+	if len(r.Cycles) == 0 && m.OnStart != nil {
+		m.OnStart(r)
+	}
+
+	if r.Volume > 0 {
+		r.Litres, err = r.Valve.WaterVolume(ctx, m.c, r.Volume, cycle)
+	} else {
+		var start uint64
+		fm := m.c.FlowMeter
+		if fm != nil && fm.Counter != nil {
+			start, _ = fm.Counter.Count()
+		}
+		err = r.Valve.Water(ctx, m.c, cycle)
+		if fm != nil && fm.Counter != nil {
+			litres, _ := fm.LitresSince(start)
+			r.Litres += litres
+		}
+	}
+
+	elapsed := int(time.Since(opened).Round(time.Second).Seconds())
+	if elapsed > cycle {
+		elapsed = cycle
+	}
+	r.Cycles = append(r.Cycles, RunCycle{Start: opened, Seconds: elapsed})
+	r.remaining -= cycle
+	return err
+}
+
+// stop a run before it opens the valve again, recording why so it's logged as stopped rather than failed
+func (m *RunManager) stopBefore(r *Run, reason string) error {
+	m.mu.Lock()
+	r.Stopped = reason
+	m.mu.Unlock()
+	return fmt.Errorf("stopped before watering: %v", reason)
+}
+
+// total seconds the valve was open across all cycles
+func (r *Run) Watered() int {
+	total := 0
+	for _, cy := range r.Cycles {
+		total += cy.Seconds
+	}
+	return total
+}
+
+// check whether a valve currently has a run in progress
+func (m *RunManager) IsRunning(valveID string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.running[valveID]
+	return ok
+}
+
+// number of runs waiting to start
+func (m *RunManager) QueueLength() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.queue)
+}
+
+// stop a valve's run early or drop it from the queue,
+// returns false if the valve was neither running nor queued
+func (m *RunManager) Cancel(valveID string) bool {
+	m.mu.Lock()
+	r, ok := m.running[valveID]
+	if ok {
+		r.cancel()
+		m.mu.Unlock()
+		return true
+	}
+	for i, q := range m.queue {
+		if q.Valve.ID == valveID {
+			m.queue = append(m.queue[:i], m.queue[i+1:]...)
+			m.mu.Unlock()
+			m.drop(q, fmt.Errorf("watering cancelled"))
+			return true
+		}
+	}
+	m.mu.Unlock()
+	return false
+}
+
+// empty the queue and stop every run in progress
+func (m *RunManager) CancelAll() {
+	m.mu.Lock()
+	dropped := m.queue
+	m.queue = nil
+	for _, r := range m.running {
+		r.cancel()
+	}
+	m.mu.Unlock()
+	for _, r := range dropped {
+		m.drop(r, fmt.Errorf("watering cancelled"))
+	}
+}
+
+// stop for good when shutting down, so no valve opens after the shutdown sweep:
+// nothing more is queued or started, pending dispatches are dropped and every run is cancelled
+func (m *RunManager) Stop() {
+	m.mu.Lock()
+	m.stopped = true
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+	m.mu.Unlock()
+	m.CancelAll()
+}
+
+// stop every run in progress and drop the queue, recording why on each run.
+// queued runs are passed to OnFinish straight away
+func (m *RunManager) Abort(reason string) {
+	m.mu.Lock()
+	dropped := m.queue
+	m.queue = nil
+	for _, r := range m.running {
+		r.Stopped = reason
+		r.cancel()
+	}
+	m.mu.Unlock()
+
+	for _, r := range dropped {
+		r.Stopped = reason
+		r.Err = fmt.Errorf("dropped from queue: %v", reason)
+		if r.reserved {
+			m.finish(r, r.Err)
+			continue
+		}
+		if m.OnFinish != nil {
+			m.OnFinish(r)
+		}
+		m.wg.Done()
+	}
+}
+
+// a run taken out of the queue, finished if it was soaking between cycles
+// so its watering so far is logged, caller must not hold the lock
+func (m *RunManager) drop(r *Run, err error) {
+	if r.reserved {
+		m.finish(r, err)
+		return
+	}
+	m.wg.Done()
+}
+
+// block until the queue is empty and every run has finished
+func (m *RunManager) Wait() {
+	m.wg.Wait()
+}
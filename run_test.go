@@ -0,0 +1,261 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func testRunConfig(t *testing.T, ids ...string) *Config {
+	c := &Config{Driver: "fake"}
+	for _, id := range ids {
+		c.Valves = append(c.Valves, &Valve{ID: id, Name: "valve " + id})
+	}
+	err := c.InitDrivers()
+	if err != nil {
+		t.Fatalf("could not init drivers: %v", err)
+	}
+	return c
+}
+
+func TestRunManagerConcurrent(t *testing.T) {
+	c := testRunConfig(t, "1", "2")
+	c.MaxConcurrentValves = 2
+	m := NewRunManager(c)
+
+	err := m.Enqueue(&Run{Valve: c.Valves[0], Duration: 1})
+	if err != nil {
+		t.Fatalf("could not queue run: %v", err)
+	}
+	// queueing doesn't block, so a second valve can be started straight away
+	err = m.Enqueue(&Run{Valve: c.Valves[1], Duration: 1})
+	if err != nil {
+		t.Fatalf("could not queue run: %v", err)
+	}
+	if !m.IsRunning("1") || !m.IsRunning("2") {
+		t.Error("expected both valves to be running")
+	}
+	if m.Enqueue(&Run{Valve: c.Valves[0], Duration: 1}) == nil {
+		t.Error("expected error queueing a valve that is already running")
+	}
+
+	m.Wait()
+	if m.IsRunning("1") || m.IsRunning("2") {
+		t.Error("expected no valves to be running after wait")
+	}
+}
+
+func TestRunManagerQueue(t *testing.T) {
+	c := testRunConfig(t, "1", "2", "3")
+	c.InterZoneDelay = 1
+	m := NewRunManager(c)
+	fake := c.Valves[0].Device.(*FakeDriver)
+
+	var started []*Run
+	m.OnStart = func(r *Run) {
+		started = append(started, r)
+	}
+
+	for _, v := range c.Valves {
+		err := m.Enqueue(&Run{Valve: v, Duration: 1})
+		if err != nil {
+			t.Fatalf("could not queue run: %v", err)
+		}
+	}
+	if m.QueueLength() != 2 {
+		t.Errorf("expected 2 queued runs, got %v", m.QueueLength())
+	}
+	m.Wait()
+
+	// valves must open one at a time, in order, with the delay between them
+	trs := fake.Transitions()
+	if len(trs) != 6 {
+		t.Fatalf("expected 6 transitions, got %v", len(trs))
+	}
+	for i, v := range c.Valves {
+		open, closed := trs[i*2], trs[i*2+1]
+		if open.ValveID != v.ID || !open.Open || closed.ValveID != v.ID || closed.Open {
+			t.Errorf("unexpected transitions for valve %v: %+v %+v", v.ID, open, closed)
+		}
+		if i > 0 && open.Time.Sub(trs[i*2-1].Time) < time.Second {
+			t.Errorf("valve %v opened %v after previous closed, expected at least 1s", v.ID, open.Time.Sub(trs[i*2-1].Time))
+		}
+	}
+
+	if len(started) != 3 {
+		t.Fatalf("expected 3 runs to start, got %v", len(started))
+	}
+	if !started[2].Started.After(started[2].Queued.Add(2 * time.Second)) {
+		t.Errorf("expected last run to start well after it was queued, queued %v started %v", started[2].Queued, started[2].Started)
+	}
+}
+
+func TestRunManagerCancel(t *testing.T) {
+	c := testRunConfig(t, "1", "2")
+	m := NewRunManager(c)
+	finished := make(chan *Run, 2)
+	m.OnFinish = func(r *Run) {
+		finished <- r
+	}
+
+	err := m.Enqueue(&Run{Valve: c.Valves[0], Duration: 60})
+	if err != nil {
+		t.Fatalf("could not queue run: %v", err)
+	}
+	err = m.Enqueue(&Run{Valve: c.Valves[1], Duration: 60})
+	if err != nil {
+		t.Fatalf("could not queue run: %v", err)
+	}
+	if !m.Cancel("2") {
+		t.Error("expected cancel to find queued valve")
+	}
+	if !m.Cancel("1") {
+		t.Error("expected cancel to find running valve")
+	}
+
+	select {
+	case r := <-finished:
+		if r.Err == nil {
+			t.Error("expected cancelled run to report an error")
+		}
+		if r.Finished.Sub(r.Started) > 5*time.Second {
+			t.Errorf("cancelled run took too long: %v", r.Finished.Sub(r.Started))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not finish after cancel")
+	}
+	m.Wait()
+
+	if len(finished) != 0 {
+		t.Error("expected cancelled queued run to never start")
+	}
+	open, _ := c.Valves[0].Device.IsOpen(c.Valves[0])
+	if open {
+		t.Error("expected valve to be closed after cancel")
+	}
+}
+
+func TestRunManagerStop(t *testing.T) {
+	c := testRunConfig(t, "1", "2")
+	c.InterZoneDelay = 1
+	m := NewRunManager(c)
+	var started []string
+	m.OnStart = func(r *Run) {
+		started = append(started, r.Valve.ID)
+	}
+
+	err := m.Enqueue(&Run{Valve: c.Valves[0], Duration: 60})
+	if err != nil {
+		t.Fatalf("could not queue run: %v", err)
+	}
+	err = m.Enqueue(&Run{Valve: c.Valves[1], Duration: 1})
+	if err != nil {
+		t.Fatalf("could not queue run: %v", err)
+	}
+	m.Stop()
+	m.Wait()
+	// the inter-zone delay timer mustn't start the queued run after stopping
+	time.Sleep(1500 * time.Millisecond)
+
+	if len(started) != 1 || m.IsRunning("2") {
+		t.Errorf("expected only valve 1 to have started, got %v", started)
+	}
+	if m.Enqueue(&Run{Valve: c.Valves[1], Duration: 1}) == nil {
+		t.Error("expected error queueing after stop")
+	}
+	for _, v := range c.Valves {
+		open, _ := v.Device.IsOpen(v)
+		if open {
+			t.Errorf("expected valve %v to be closed after stop", v.ID)
+		}
+	}
+}
+
+func TestRunManagerCycleSoak(t *testing.T) {
+	c := testRunConfig(t, "1", "2")
+	m := NewRunManager(c)
+	fake := c.Valves[0].Device.(*FakeDriver)
+
+	finished := make(chan *Run, 2)
+	m.OnFinish = func(r *Run) {
+		finished <- r
+	}
+	for _, v := range c.Valves {
+		err := m.Enqueue(&Run{Valve: v, Duration: 2, Cycle: 1, Soak: 1})
+		if err != nil {
+			t.Fatalf("could not queue run: %v", err)
+		}
+	}
+	m.Wait()
+
+	// each valve waters in two cycles, with the other valve's cycle in its soak time
+	trs := fake.Transitions()
+	order := []string{"1", "2", "1", "2"}
+	if len(trs) != 8 {
+		t.Fatalf("expected 8 transitions, got %v", len(trs))
+	}
+	for i, id := range order {
+		open, closed := trs[i*2], trs[i*2+1]
+		if open.ValveID != id || !open.Open || closed.ValveID != id || closed.Open {
+			t.Errorf("unexpected transitions for cycle %v: %+v %+v", i, open, closed)
+		}
+	}
+
+	for range c.Valves {
+		r := <-finished
+		if r.Err != nil {
+			t.Errorf("unexpected error on valve %v: %v", r.Valve.ID, r.Err)
+		}
+		if len(r.Cycles) != 2 || r.Watered() != 2 {
+			t.Errorf("expected 2 cycles of 1s on valve %v, got %+v", r.Valve.ID, r.Cycles)
+		}
+		if r.Cycles[1].Start.Sub(r.Cycles[0].Start) < 2*time.Second {
+			t.Errorf("expected at least 1s soak on valve %v, cycles %+v", r.Valve.ID, r.Cycles)
+		}
+	}
+	if m.RuntimeToday("") != 4 {
+		t.Errorf("expected 4s of runtime today, got %v", m.RuntimeToday(""))
+	}
+}
+
+func TestRunManagerCancelSoaking(t *testing.T) {
+	c := testRunConfig(t, "1")
+	m := NewRunManager(c)
+	finished := make(chan *Run, 1)
+	m.OnFinish = func(r *Run) {
+		finished <- r
+	}
+
+	err := m.Enqueue(&Run{Valve: c.Valves[0], Duration: 3, Cycle: 1, Soak: 60})
+	if err != nil {
+		t.Fatalf("could not queue run: %v", err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if m.QueueLength() != 1 {
+		t.Fatalf("expected run to be soaking in the queue, queue length %v", m.QueueLength())
+	}
+	if !m.Cancel("1") {
+		t.Fatal("expected soaking run to be cancelled")
+	}
+	m.Wait()
+
+	// the cycle that ran is still reported, and the unused runtime returned
+	r := <-finished
+	if r.Err == nil || len(r.Cycles) != 1 {
+		t.Errorf("expected cancelled run with 1 cycle, got err %v cycles %+v", r.Err, r.Cycles)
+	}
+	if m.RuntimeToday("1") != 1 {
+		t.Errorf("expected 1s of runtime today, got %v", m.RuntimeToday("1"))
+	}
+}
+
+func TestCycleSoak(t *testing.T) {
+	v := &Valve{CycleSeconds: 300, SoakSeconds: 600}
+	cycle, soak := v.CycleSoak(&WaterTimepoint{})
+	if cycle != 300 || soak != 600 {
+		t.Errorf("expected valve settings, got %v %v", cycle, soak)
+	}
+	cycle, soak = v.CycleSoak(&WaterTimepoint{CycleSeconds: 120, SoakSeconds: 900})
+	if cycle != 120 || soak != 900 {
+		t.Errorf("expected timepoint settings, got %v %v", cycle, soak)
+	}
+}
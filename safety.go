@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+/*
+Safety net so that a zone is never left running when the process goes away.
+Every exit path we control (signals, panics) closes all valves first,
+and on startup every valve is forced closed in case the last run died mid-water
+*/
+
+// drive every configured valve closed, including the master, attempting all valves even if some fail
+func (c *Config) CloseAllValves() error {
+	return errors.Join(c.CloseValves(false), c.CloseValves(true))
+}
+
+// whether a driver's relays switch themselves off, see remote.go.
+// they can be unreachable, e.g. with the wi-fi down, but won't stay open if they are.
+// modbus relays have no auto-off, so they count as local however they're reached
+func autoOffDriver(name string) bool {
+	return name == "http"
+}
+
+// drive closed every valve, including the master, on a driver whose relays switch themselves off or on any other,
+// attempting all valves even if some fail
+func (c *Config) CloseValves(autoOff bool) error {
+	var errs []error
+	for _, v := range c.Valves {
+		if autoOffDriver(c.ValveDriver(v)) != autoOff {
+			continue
+		}
+		if v.Device == nil {
+			errs = append(errs, fmt.Errorf("no driver configured for valve %v (%v)", v.ID, v.Name))
+			continue
+		}
+		err := v.Device.Close(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not close valve %v (%v): %v", v.ID, v.Name, err))
+		}
+	}
+	if c.Master != nil && c.Master.Device != nil && autoOffDriver(c.ValveDriver(&c.Master.Valve)) == autoOff {
+		err := c.Master.Device.Close(&c.Master.Valve)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not close master valve: %v", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// trap termination signals, stop the runs, close every valve and exit
+func HandleShutdownSignals(c *Config, runs *RunManager) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		sig := <-sigs
+		runs.Stop()
+		err := c.CloseAllValves()
+		if err != nil {
+			log.Printf("could not close all valves on %v: %v", sig, err)
+		}
+		logerr := LogError(c, fmt.Errorf("received %v, closed all valves and shutting down", sig))
+		if logerr != nil {
+			log.Printf("could not log error: %v", logerr)
+		}
+		// a run cancelled in the middle of opening its valve may have opened it after the first sweep
+		_ = c.CloseAllValves()
+		os.Exit(1)
+	}()
+}
+
+// close every valve if the calling goroutine panics, then continue panicking.
+// must be deferred directly, i.e. defer RecoverValves(config)
+func RecoverValves(c *Config) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	err := c.CloseAllValves()
+	if err != nil {
+		log.Printf("could not close all valves after panic: %v", err)
+	}
+	panic(r)
+}
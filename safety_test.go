@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCloseAllValves(t *testing.T) {
+	c := &Config{
+		Driver: "fake",
+		Valves: []*Valve{
+			&Valve{ID: "1", Name: "one"},
+			&Valve{ID: "2", Name: "two"},
+		},
+	}
+	err := c.InitDrivers()
+	if err != nil {
+		t.Fatalf("could not init drivers: %v", err)
+	}
+	for _, v := range c.Valves {
+		_ = v.Device.Open(v)
+	}
+
+	err = c.CloseAllValves()
+	if err != nil {
+		t.Errorf("could not close all valves: %v", err)
+	}
+	for _, v := range c.Valves {
+		open, _ := v.Device.IsOpen(v)
+		if open {
+			t.Errorf("expected valve %v to be closed", v.ID)
+		}
+	}
+}
+
+func TestRecoverValves(t *testing.T) {
+	c := &Config{
+		Driver: "fake",
+		Valves: []*Valve{
+			&Valve{ID: "1", Name: "one"},
+		},
+	}
+	err := c.InitDrivers()
+	if err != nil {
+		t.Fatalf("could not init drivers: %v", err)
+	}
+	v := c.Valves[0]
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected panic to propagate")
+			}
+		}()
+		defer RecoverValves(c)
+		_ = v.Device.Open(v)
+		panic("boom")
+	}()
+
+	open, _ := v.Device.IsOpen(v)
+	if open {
+		t.Error("expected valve to be closed after panic")
+	}
+}
+
+func TestCloseValvesAutoOff(t *testing.T) {
+	relay := &fakeRelay{failures: 100}
+	_, remote := testRemoteValve(t, relay, 60)
+	remote.ID, remote.Driver = "2", "http"
+	c := &Config{
+		Driver: "fake",
+		Valves: []*Valve{&Valve{ID: "1", Name: "one"}, remote},
+	}
+	err := c.InitDrivers()
+	if err != nil {
+		t.Fatalf("could not init drivers: %v", err)
+	}
+
+	// the unreachable relay only fails the auto-off sweep
+	err = c.CloseValves(false)
+	if err != nil {
+		t.Errorf("expected local valves to close: %v", err)
+	}
+	if c.CloseValves(true) == nil {
+		t.Error("expected error closing unreachable relay")
+	}
+	if c.CloseAllValves() == nil {
+		t.Error("expected error closing all valves")
+	}
+
+	// modbus relays don't switch themselves off, so they're closed with the local valves
+	if autoOffDriver("modbus") {
+		t.Error("expected modbus valves not to count as switching themselves off")
+	}
+}
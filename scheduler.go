@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+)
+
+/*
+Fires timepoints at their scheduled times.
+The scheduler works out when the next timepoint across all valves is due and sleeps until then,
+waking at least every schedulerMaxSleep so a change to the wall clock is noticed.
+
+Each time it wakes it fires every occurrence scheduled after the last time it checked, up to now.
+That time only ever moves forward, so an occurrence can't fire twice when the clock is set back
+(an NTP correction, or the repeated hour when DST ends). When the wall clock moves further
+than the time that really passed, e.g. when a Pi without an rtc gets its time from NTP,
+only the time that really passed is checked, so the jump doesn't fire a backlog of occurrences.
+Occurrences skipped over by the jump, within config.MissedGrace, go to Missed instead,
+so each is handled by its timepoint's missed policy rather than silently dropped.
+Occurrences are built from the local date, so each fires once a day, even across DST changes.
+Occurrences on dates watering is blocked on go to Skip instead, see calendar.go
+*/
+
+// longest the scheduler sleeps between checking the clock
+const schedulerMaxSleep = time.Minute
+
+// how far ahead to look for the next occurrence
+const schedulerHorizon = 400
+
+// a timepoint on a valve due at a particular time
+type Occurrence struct {
+	Valve     *Valve
+	Timepoint *WaterTimepoint
+	Time      time.Time
+}
+
+type Scheduler struct {
+	c    *Config
+	loc  *time.Location
+	last time.Time          // occurrences at or before this have been handled
+	Fire func(o Occurrence) // called for each occurrence, in time order
+
+	Missed func(o Occurrence, reason string) // called for each occurrence missed within the grace window, see CatchUp and Step
+
+	Skip func(o Occurrence, reason string) // called instead of Fire or Missed when watering is blocked, see Config.Blocked
+}
+
+func NewScheduler(c *Config) *Scheduler {
+	return &Scheduler{c: c, loc: time.Local}
+}
+
+// every occurrence after from, up to and including to, oldest first
+func (s *Scheduler) Occurrences(from time.Time, to time.Time) []Occurrence {
+	var occs []Occurrence
+	if !to.After(from) {
+		return occs
+	}
+	for day := from.In(s.loc); !day.After(to.AddDate(0, 0, 1)); day = day.AddDate(0, 0, 1) {
+		for _, v := range s.c.Valves {
+			for _, tp := range v.Timepoints {
+				for _, at := range tp.Times(s.c, day, s.loc) {
+					if at.After(from) && !at.After(to) {
+						occs = append(occs, Occurrence{Valve: v, Timepoint: tp, Time: at})
+					}
+				}
+			}
+		}
+	}
+	sort.SliceStable(occs, func(i, j int) bool {
+		return occs[i].Time.Before(occs[j].Time)
+	})
+	return occs
+}
+
+// time of the first occurrence after t, false if nothing is scheduled
+func (s *Scheduler) Next(t time.Time) (time.Time, bool) {
+	var next time.Time
+	for i := 0; i <= schedulerHorizon; i++ {
+		day := t.In(s.loc).AddDate(0, 0, i)
+		for _, v := range s.c.Valves {
+			for _, tp := range v.Timepoints {
+				for _, at := range tp.Times(s.c, day, s.loc) {
+					if at.After(t) && (next.IsZero() || at.Before(next)) {
+						next = at
+						break
+					}
+				}
+			}
+		}
+		if !next.IsZero() {
+			return next, true
+		}
+	}
+	return next, false
+}
+
+// occurrences due at now, given that elapsed really passed since the last step,
+// and occurrences skipped over by the clock jumping forward, going back no further than config.MissedGrace minutes
+func (s *Scheduler) Step(now time.Time, elapsed time.Duration) ([]Occurrence, []Occurrence) {
+	from := s.last
+	var missed []Occurrence
+	if real := now.Add(-elapsed); real.After(from) {
+		skipped := s.last
+		if graceFrom := real.Add(-s.grace()); graceFrom.After(skipped) {
+			skipped = graceFrom
+		}
+		missed = s.Occurrences(skipped, real)
+		from = real
+	}
+	occs := s.Occurrences(from, now)
+	if now.After(s.last) {
+		s.last = now
+	}
+	return occs, missed
+}
+
+// how far back missed occurrences are handled
+func (s *Scheduler) grace() time.Duration {
+	grace := s.c.MissedGrace
+	if grace <= 0 {
+		grace = 60
+	}
+	return time.Duration(grace) * time.Minute
+}
+
+// occurrences missed since the state file was last saved, going back no further than
+// config.MissedGrace minutes, for handling on startup
+func (s *Scheduler) CatchUp(now time.Time) []Occurrence {
+	if s.c.State == nil {
+		return nil
+	}
+	last := s.c.State.Evaluated()
+	if last.IsZero() {
+		return nil
+	}
+	from := now.Add(-s.grace())
+	if last.After(from) {
+		from = last
+	}
+	return s.Occurrences(from, now)
+}
+
+// record how far timepoints have been handled in the state file
+func (s *Scheduler) save() {
+	if s.c.State == nil {
+		return
+	}
+	err := s.c.State.SetEvaluated(s.last)
+	if err != nil {
+		logerr := LogError(s.c, err)
+		if logerr != nil {
+			log.Printf("could not log error: %v", logerr)
+		}
+	}
+}
+
+// hand an occurrence missed for reason to Missed, or to Skip if watering is blocked on its date
+func (s *Scheduler) handleMissed(o Occurrence, reason string) {
+	s.handle(o, func(o Occurrence) {
+		if s.Missed != nil {
+			s.Missed(o, reason)
+		}
+	})
+}
+
+// hand an occurrence to fn, or to Skip if watering is blocked on its date
+func (s *Scheduler) handle(o Occurrence, fn func(o Occurrence)) {
+	reason := s.c.Blocked(o.Time)
+	if reason != "" {
+		if s.Skip != nil {
+			s.Skip(o, reason)
+		}
+		return
+	}
+	if fn != nil {
+		fn(o)
+	}
+}
+
+// hand missed occurrences to Missed, then fire occurrences as they come due, until ctx is done
+func (s *Scheduler) Run(ctx context.Context) {
+	// time.Now carries a monotonic reading, so Sub gives the time that really passed
+	prev := time.Now()
+	if s.last.IsZero() {
+		s.last = prev.Round(0)
+		missed := s.CatchUp(s.last)
+		for _, o := range missed {
+			s.handleMissed(o, "system was not running")
+		}
+		if len(missed) > 0 {
+			s.save()
+		}
+	}
+	for {
+		wait := schedulerMaxSleep
+		next, ok := s.Next(prev)
+		if ok && next.Sub(prev.Round(0)) < wait {
+			wait = next.Sub(prev.Round(0))
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		due, missed := s.Step(now.Round(0), now.Sub(prev))
+		for _, o := range missed {
+			s.handleMissed(o, "clock jumped forward")
+		}
+		for _, o := range due {
+			s.handle(o, s.Fire)
+		}
+		// only save when something was handled, to spare the sd card a write every wake.
+		// a saved time left behind is fine, CatchUp looks back no further than the grace window anyway
+		if len(due)+len(missed) > 0 {
+			s.save()
+		}
+		prev = now
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testScheduler(t *testing.T, loc *time.Location) *Scheduler {
+	c := &Config{Valves: []*Valve{
+		&Valve{ID: "1", Timepoints: []*WaterTimepoint{
+			&WaterTimepoint{Days: []int{0, 1, 2, 3, 4, 5, 6}, Hour: 1, Minute: 30},
+			&WaterTimepoint{Days: []int{1}, Hour: 7, Minute: 0},
+		}},
+		&Valve{ID: "2", Timepoints: []*WaterTimepoint{
+			&WaterTimepoint{Days: []int{0, 1, 2, 3, 4, 5, 6}, Hour: 7, Minute: 0},
+		}},
+	}}
+	s := NewScheduler(c)
+	s.loc = loc
+	return s
+}
+
+func TestSchedulerOccurrences(t *testing.T) {
+	s := testScheduler(t, time.UTC)
+	// monday
+	from := time.Date(2024, 6, 17, 0, 0, 0, 0, time.UTC)
+	occs := s.Occurrences(from, from.Add(24*time.Hour))
+	if len(occs) != 3 {
+		t.Fatalf("expected 3 occurrences, got %v", len(occs))
+	}
+	if occs[0].Time.Hour() != 1 || occs[1].Valve.ID != "1" || occs[2].Valve.ID != "2" || !occs[1].Time.Equal(occs[2].Time) {
+		t.Errorf("unexpected occurrences %+v", occs)
+	}
+
+	next, ok := s.Next(time.Date(2024, 6, 17, 7, 0, 0, 0, time.UTC))
+	if !ok || !next.Equal(time.Date(2024, 6, 18, 1, 30, 0, 0, time.UTC)) {
+		t.Errorf("unexpected next occurrence %v", next)
+	}
+}
+
+func TestSchedulerStep(t *testing.T) {
+	s := testScheduler(t, time.UTC)
+	start := time.Date(2024, 6, 18, 1, 29, 0, 0, time.UTC)
+	s.last = start
+
+	// woken just after the timepoint, it fires once
+	now := start.Add(61 * time.Second)
+	if due, missed := s.Step(now, 61*time.Second); len(due) != 1 || len(missed) != 0 {
+		t.Errorf("expected 1 occurrence, got %v and %v missed", len(due), len(missed))
+	}
+	if due, _ := s.Step(now.Add(time.Second), time.Second); len(due) != 0 {
+		t.Errorf("expected no repeat, got %v", len(due))
+	}
+
+	// clock set back over the timepoint, it doesn't fire again
+	back := start.Add(30 * time.Second)
+	if due, missed := s.Step(back, time.Second); len(due)+len(missed) != 0 {
+		t.Errorf("expected no repeat after clock set back, got %v and %v missed", len(due), len(missed))
+	}
+	if due, missed := s.Step(back.Add(time.Minute), time.Minute); len(due)+len(missed) != 0 {
+		t.Errorf("expected no repeat as clock catches up, got %v and %v missed", len(due), len(missed))
+	}
+
+	// clock jumps forward over a timepoint, it doesn't fire but is missed
+	s.last = time.Date(2024, 6, 18, 7, 0, 0, 0, time.UTC)
+	jump := s.last.Add(2 * time.Minute)
+	s.c.Valves[1].Timepoints[0].Minute = 1
+	due, missed := s.Step(jump, time.Minute)
+	if len(due) != 0 {
+		t.Errorf("expected nothing to fire over a clock jump, got %v", len(due))
+	}
+	if len(missed) != 1 || missed[0].Time.Minute() != 1 {
+		t.Errorf("expected the 7:01 occurrence to be missed, got %+v", missed)
+	}
+
+	// jumping a day forward, only those within the grace window are missed, not the 1:30
+	s.last = time.Date(2024, 6, 18, 7, 30, 0, 0, time.UTC)
+	jump = s.last.Add(24 * time.Hour)
+	due, missed = s.Step(jump, time.Second)
+	if len(due) != 0 || len(missed) != 1 || missed[0].Valve.ID != "2" {
+		t.Errorf("expected only the 7:01 occurrence to be missed, got %+v and %+v", due, missed)
+	}
+}
+
+func TestSchedulerDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	s := testScheduler(t, loc)
+	s.c.Valves[0].Timepoints = append(s.c.Valves[0].Timepoints, &WaterTimepoint{Days: []int{0}, Hour: 2, Minute: 30})
+
+	// 1:30 happens twice when DST ends, and 2:30 not at all when it starts,
+	// each still fires exactly once
+	for _, day := range []time.Time{
+		time.Date(2024, 11, 3, 0, 0, 0, 0, loc),
+		time.Date(2024, 3, 10, 0, 0, 0, 0, loc),
+	} {
+		s.last = day
+		fired := make(map[int]int)
+		for now := day; now.Before(day.Add(6 * time.Hour)); now = now.Add(time.Minute) {
+			due, _ := s.Step(now, time.Minute)
+			for _, o := range due {
+				fired[o.Timepoint.Hour]++
+			}
+		}
+		if fired[1] != 1 || fired[2] != 1 {
+			t.Errorf("expected 1:30 and 2:30 to fire once on %v, fired %v", day.Format("2006-01-02"), fired)
+		}
+	}
+}
+
+func TestSchedulerCatchUp(t *testing.T) {
+	s := testScheduler(t, time.UTC)
+	st, err := LoadState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatalf("could not load state: %v", err)
+	}
+	s.c.State = st
+	// monday 7:10, last running at 1:00
+	now := time.Date(2024, 6, 17, 7, 10, 0, 0, time.UTC)
+	if len(s.CatchUp(now)) != 0 {
+		t.Error("expected nothing to catch up without a saved time")
+	}
+	st.SetEvaluated(time.Date(2024, 6, 17, 1, 0, 0, 0, time.UTC))
+
+	// only the 7:00 timepoints are within the default hour of grace
+	occs := s.CatchUp(now)
+	if len(occs) != 2 || occs[0].Time.Hour() != 7 || occs[1].Time.Hour() != 7 {
+		t.Errorf("expected the two 7:00 occurrences, got %+v", occs)
+	}
+	s.c.MissedGrace = 6 * 60
+	if n := len(s.CatchUp(now)); n != 3 {
+		t.Errorf("expected 3 occurrences with a longer grace, got %v", n)
+	}
+}
+
+func TestLogMissed(t *testing.T) {
+	c := &Config{EventLogFile: filepath.Join(t.TempDir(), "events.log")}
+	v := &Valve{ID: "1", Name: "test"}
+	err := v.LogMissed(c, time.Date(2024, 6, 17, 7, 1, 0, 0, time.Local), "system was not running", false)
+	if err != nil {
+		t.Fatalf("could not log missed timepoint: %v", err)
+	}
+	b, _ := os.ReadFile(c.EventLogFile)
+	if !strings.Contains(string(b), "Valve: 1 (test) || Missed: 2024-06-17 07:01 || Reason: system was not running") {
+		t.Errorf("unexpected log line %q", b)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+/*
+Seasonal adjust scales every timepoint's duration by a percentage that changes through the year,
+instead of editing each duration in config.json when the seasons turn.
+A table is either a percentage per month, or percentages on dates with the days between
+interpolated linearly, wrapping around from the last date of the year to the first.
+A valve's own table replaces the config level one. The adjusted duration is worked out when
+a timepoint fires and recorded in the event log along with the percentage, and a timepoint
+adjusted to 0% is skipped
+*/
+
+type SeasonalAdjust struct {
+	Monthly []float64       `json:"monthly"` // 12 percentages, january first
+	Points  []SeasonalPoint `json:"points"`  // percentages on dates, interpolated between, used instead of monthly
+}
+
+type SeasonalPoint struct {
+	Date    string  `json:"date"`    // month and day, as 01-02
+	Percent float64 `json:"percent"` // percentage of the timepoint's duration to water on this date
+}
+
+func (sa *SeasonalAdjust) Check() error {
+	if (len(sa.Monthly) > 0) == (len(sa.Points) > 0) {
+		return fmt.Errorf("seasonal adjust needs either monthly or points, not both")
+	}
+	if len(sa.Monthly) > 0 && len(sa.Monthly) != 12 {
+		return fmt.Errorf("seasonal adjust monthly needs 12 percentages, got %v", len(sa.Monthly))
+	}
+	for _, pct := range sa.Monthly {
+		if pct < 0 {
+			return fmt.Errorf("seasonal adjust can't have a negative percentage")
+		}
+	}
+	seen := make(map[string]bool)
+	for _, p := range sa.Points {
+		_, err := time.Parse("01-02", p.Date)
+		if err != nil {
+			return fmt.Errorf("seasonal adjust point date %q must be like 01-02", p.Date)
+		}
+		if seen[p.Date] {
+			return fmt.Errorf("seasonal adjust has more than one point on %v", p.Date)
+		}
+		seen[p.Date] = true
+		if p.Percent < 0 {
+			return fmt.Errorf("seasonal adjust can't have a negative percentage")
+		}
+	}
+	return nil
+}
+
+// percentage to water on the date of t, in t's location
+func (sa *SeasonalAdjust) Percent(t time.Time) float64 {
+	if len(sa.Points) == 0 {
+		return sa.Monthly[t.Month()-1]
+	}
+
+	type point struct {
+		at  time.Time
+		pct float64
+	}
+	y, m, d := t.Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	points := make([]point, 0, len(sa.Points))
+	for _, p := range sa.Points {
+		pd, _ := time.Parse("01-02", p.Date)
+		points = append(points, point{time.Date(y, pd.Month(), pd.Day(), 0, 0, 0, 0, time.UTC), p.Percent})
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].at.Before(points[j].at) })
+
+	// last point on or before the day and the first one after it, from the year either side if need be
+	i := sort.Search(len(points), func(i int) bool { return points[i].at.After(day) })
+	var prev, next point
+	if i == 0 {
+		prev = points[len(points)-1]
+		prev.at = prev.at.AddDate(-1, 0, 0)
+	} else {
+		prev = points[i-1]
+	}
+	if i == len(points) {
+		next = points[0]
+		next.at = next.at.AddDate(1, 0, 0)
+	} else {
+		next = points[i]
+	}
+	if prev.at.Equal(day) || !next.at.After(prev.at) {
+		return prev.pct
+	}
+	frac := day.Sub(prev.at).Hours() / next.at.Sub(prev.at).Hours()
+	return prev.pct + (next.pct-prev.pct)*frac
+}
+
+// the seasonal adjust table that applies to a valve, nil if there is none
+func (v *Valve) seasonal(c *Config) *SeasonalAdjust {
+	if v.Seasonal != nil {
+		return v.Seasonal
+	}
+	return c.Seasonal
+}
+
+// a timepoint's duration and volume scaled by the seasonal adjust for the date of t,
+// along with the percentage used, which is 100 when no table is configured
+func (v *Valve) SeasonalDuration(c *Config, tp *WaterTimepoint, t time.Time) (int, float32, float64) {
+	sa := v.seasonal(c)
+	if sa == nil {
+		return tp.Duration, tp.VolumeL, 100
+	}
+	pct := sa.Percent(t)
+	duration := int(math.Round(float64(tp.Duration) * pct / 100))
+	volume := float32(float64(tp.VolumeL) * pct / 100)
+	return duration, volume, pct
+}
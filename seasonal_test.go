@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSeasonalPercent(t *testing.T) {
+	day := func(m time.Month, d int) time.Time {
+		return time.Date(2024, m, d, 7, 0, 0, 0, time.Local)
+	}
+	monthly := &SeasonalAdjust{Monthly: []float64{0, 0, 30, 60, 80, 100, 120, 120, 90, 50, 20, 0}}
+	if pct := monthly.Percent(day(7, 15)); pct != 120 {
+		t.Errorf("expected 120%% in july, got %v", pct)
+	}
+	if pct := monthly.Percent(day(1, 31)); pct != 0 {
+		t.Errorf("expected 0%% in january, got %v", pct)
+	}
+
+	points := &SeasonalAdjust{Points: []SeasonalPoint{
+		{"07-01", 120},
+		{"04-01", 40},
+		{"10-01", 60},
+	}}
+	cases := []struct {
+		t   time.Time
+		pct float64
+	}{
+		{day(4, 1), 40},
+		{day(7, 1), 120},
+		// 45 of 91 days from april to july
+		{day(5, 16), 40 + 80*45.0/91},
+		// between october and april, across the new year
+		{day(1, 1), 60 - 20*92.0/183},
+		{day(12, 31), 60 - 20*91.0/182},
+	}
+	for _, tc := range cases {
+		pct := points.Percent(tc.t)
+		if math.Abs(pct-tc.pct) > 0.01 {
+			t.Errorf("expected %.2f%% on %v, got %.2f%%", tc.pct, tc.t.Format("01-02"), pct)
+		}
+	}
+
+	single := &SeasonalAdjust{Points: []SeasonalPoint{{"06-01", 80}}}
+	if pct := single.Percent(day(12, 1)); pct != 80 {
+		t.Errorf("expected a single point to apply all year, got %v", pct)
+	}
+}
+
+func TestSeasonalCheck(t *testing.T) {
+	for _, sa := range []*SeasonalAdjust{
+		{},
+		{Monthly: []float64{100, 100}},
+		{Monthly: []float64{100, 100, 100, 100, 100, 100, 100, 100, 100, 100, 100, -1}},
+		{Points: []SeasonalPoint{{"13-01", 100}}},
+		{Points: []SeasonalPoint{{"06-01", 100}, {"06-01", 50}}},
+		{Points: []SeasonalPoint{{"06-01", 100}}, Monthly: []float64{100}},
+	} {
+		if sa.Check() == nil {
+			t.Errorf("expected error checking %+v", sa)
+		}
+	}
+	sa := &SeasonalAdjust{Points: []SeasonalPoint{{"02-29", 50}, {"08-01", 100}}}
+	if err := sa.Check(); err != nil {
+		t.Errorf("expected points to be valid: %v", err)
+	}
+}
+
+func TestSeasonalDuration(t *testing.T) {
+	c := &Config{Seasonal: &SeasonalAdjust{Points: []SeasonalPoint{{"01-01", 50}}}}
+	tp := &WaterTimepoint{Duration: 75, VolumeL: 10}
+	v := &Valve{ID: "1"}
+	duration, volume, pct := v.SeasonalDuration(c, tp, time.Now())
+	if duration != 38 || volume != 5 || pct != 50 {
+		t.Errorf("expected config level 50%%, got %vs %vL %v%%", duration, volume, pct)
+	}
+
+	v.Seasonal = &SeasonalAdjust{Points: []SeasonalPoint{{"01-01", 200}}}
+	duration, _, _ = v.SeasonalDuration(c, tp, time.Now())
+	if duration != 150 {
+		t.Errorf("expected valve table to replace the config one, got %vs", duration)
+	}
+
+	duration, _, pct = (&Valve{}).SeasonalDuration(&Config{}, &WaterTimepoint{Duration: 75}, time.Now())
+	if duration != 75 || pct != 100 {
+		t.Errorf("expected no adjustment without a table, got %vs %v%%", duration, pct)
+	}
+}
+
+func TestLogRunSeasonal(t *testing.T) {
+	c := &Config{EventLogFile: filepath.Join(t.TempDir(), "events.log")}
+	now := time.Now()
+	r := &Run{
+		Valve:     &Valve{ID: "1", Name: "blueberries"},
+		Timepoint: &WaterTimepoint{Duration: 100},
+		Duration:  80,
+		Percent:   80,
+		Queued:    now,
+		Started:   now,
+		Finished:  now.Add(80 * time.Second),
+	}
+	err := LogRun(c, r)
+	if err != nil {
+		t.Fatalf("could not log run: %v", err)
+	}
+	b, _ := os.ReadFile(c.EventLogFile)
+	if !strings.Contains(string(b), "Event: 80 || Seasonal: 80% of 100s") {
+		t.Errorf("expected effective duration and seasonal adjust in event log, got %q", b)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+)
+
+// local sensor readings for a valve, taken when deciding whether to water
+type SensorData struct {
+	Moisture *float32       // soil moisture percent, nil if the valve has no probe or it couldn't be read
+	Probe    *MoistureProbe // probe the moisture reading came from
+}
+
+// read the sensors that apply to a valve. readings that fail are left empty so the
+// decision falls back to weather and schedule alone, the error is still returned for logging
+func (v *Valve) ReadSensors(c *Config) (*SensorData, error) {
+	sd := &SensorData{}
+	if v.Moisture != nil && c.MoistureADC != nil && c.MoistureADC.ADC != nil {
+		raw, err := c.MoistureADC.ADC.ReadChannel(v.Moisture.Channel)
+		if err != nil {
+			return sd, fmt.Errorf("could not read moisture probe on valve %v (%v): %v", v.ID, v.Name, err)
+		}
+		pct := v.Moisture.Percent(raw)
+		sd.Moisture = &pct
+		sd.Probe = v.Moisture
+	}
+	return sd, nil
+}
+
+// true if soil moisture is high enough that a primary timepoint should be skipped
+func (sd *SensorData) TooWet() bool {
+	return sd != nil && sd.Moisture != nil && sd.Probe.SkipAbove > 0 && *sd.Moisture > sd.Probe.SkipAbove
+}
+
+// true if soil moisture is low enough that a secondary timepoint should fire
+func (sd *SensorData) TooDry() bool {
+	return sd != nil && sd.Moisture != nil && sd.Probe.WaterBelow > 0 && *sd.Moisture < sd.Probe.WaterBelow
+}
+
+// sensor readings formatted to append to event log messages
+func (sd *SensorData) String() string {
+	if sd == nil || sd.Moisture == nil {
+		return ""
+	}
+	return fmt.Sprintf(" || Moisture: %.0f%%", *sd.Moisture)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+/*
+Sunrise and sunset for timepoints anchored to the sun, worked out locally from
+config.Latitude and config.Longitude so no network is needed.
+Uses the sunrise/sunset algorithm from the Almanac for Computers (US Naval Observatory, 1990),
+good to a minute or two away from the poles. When solar_check is set, the forecast's astro
+block is used to check the computed times, catching a wrong or swapped latitude and longitude
+*/
+
+// sun's centre 50' below the horizon, for refraction and the sun's radius
+const sunZenith = 90.833
+
+func sinDeg(d float64) float64 { return math.Sin(d * math.Pi / 180) }
+func cosDeg(d float64) float64 { return math.Cos(d * math.Pi / 180) }
+
+// wrap degrees into 0-360
+func normDeg(d float64) float64 {
+	d = math.Mod(d, 360)
+	if d < 0 {
+		d += 360
+	}
+	return d
+}
+
+// hours after utc midnight of sunrise or sunset on a day of the year, false if the sun doesn't rise or set
+func sunEventUT(yday int, lat float64, lon float64, rise bool) (float64, bool) {
+	lngHour := lon / 15
+	t := float64(yday) + (18-lngHour)/24
+	if rise {
+		t = float64(yday) + (6-lngHour)/24
+	}
+
+	// sun's mean anomaly, true longitude and right ascension, in the same quadrant as the longitude
+	m := 0.9856*t - 3.289
+	l := normDeg(m + 1.916*sinDeg(m) + 0.020*sinDeg(2*m) + 282.634)
+	ra := normDeg(math.Atan(0.91764*math.Tan(l*math.Pi/180)) * 180 / math.Pi)
+	ra += math.Floor(l/90)*90 - math.Floor(ra/90)*90
+	ra /= 15
+
+	sinDec := 0.39782 * sinDeg(l)
+	cosDec := math.Cos(math.Asin(sinDec))
+	cosH := (cosDeg(sunZenith) - sinDec*sinDeg(lat)) / (cosDec * cosDeg(lat))
+	if cosH > 1 || cosH < -1 {
+		return 0, false
+	}
+	h := math.Acos(cosH) * 180 / math.Pi
+	if rise {
+		h = 360 - h
+	}
+	h /= 15
+
+	local := h + ra - 0.06571*t - 6.622
+	return math.Mod(math.Mod(local-lngHour, 24)+24, 24), true
+}
+
+// sunrise or sunset on the date of day in loc, false if the sun doesn't rise or set that day
+func SunEvent(day time.Time, loc *time.Location, lat float64, lon float64, rise bool) (time.Time, bool) {
+	day = day.In(loc)
+	ut, ok := sunEventUT(day.YearDay(), lat, lon, rise)
+	if !ok {
+		return time.Time{}, false
+	}
+	y, m, d := day.Date()
+	at := time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Add(time.Duration(ut * float64(time.Hour)))
+	// the utc day can differ from the local one, e.g. sunset in the americas is after utc midnight
+	ly, lm, ld := at.In(loc).Date()
+	local := time.Date(ly, lm, ld, 0, 0, 0, 0, time.UTC)
+	date := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	if local.Before(date) {
+		at = at.Add(24 * time.Hour)
+	} else if local.After(date) {
+		at = at.Add(-24 * time.Hour)
+	}
+	return at, true
+}
+
+// the forecast's sunrise and sunset for its day, in local time
+func (fd *ForecastDay) SunTimes() (time.Time, time.Time, error) {
+	if fd.Astro == nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("no astro data in forecast")
+	}
+	date := fd.Date.Format("2006-01-02")
+	rise, err := time.ParseInLocation("2006-01-02 03:04 PM", date+" "+fd.Astro.Sunrise, time.Local)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("could not parse forecast sunrise: %v", err)
+	}
+	set, err := time.ParseInLocation("2006-01-02 03:04 PM", date+" "+fd.Astro.Sunset, time.Local)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("could not parse forecast sunset: %v", err)
+	}
+	return rise, set, nil
+}
+
+// compare computed sunrise and sunset with the forecast's, if config.SolarCheck is set
+func CheckSolar(c *Config, data *WeatherData) error {
+	if c.SolarCheck <= 0 || data == nil || data.Sunrise.IsZero() {
+		return nil
+	}
+	tolerance := time.Duration(c.SolarCheck) * time.Minute
+	for _, fc := range []struct {
+		name string
+		at   time.Time
+		rise bool
+	}{
+		{"sunrise", data.Sunrise, true},
+		{"sunset", data.Sunset, false},
+	} {
+		at, ok := SunEvent(fc.at, time.Local, c.Latitude, c.Longitude, fc.rise)
+		if !ok {
+			return fmt.Errorf("no %v computed for %v, but the forecast has one at %v, check latitude and longitude", fc.name, fc.at.Format("2006-01-02"), fc.at.Format("15:04"))
+		}
+		diff := at.Sub(fc.at)
+		if diff < -tolerance || diff > tolerance {
+			return fmt.Errorf("computed %v of %v is more than %v minutes from the forecast's %v, check latitude and longitude", fc.name, at.In(time.Local).Format("15:04"), c.SolarCheck, fc.at.Format("15:04"))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+// philadelphia, where the forecast fixture is for
+const testLat, testLon = 39.97, -75.17
+
+func testNewYork(t *testing.T) *time.Location {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	return loc
+}
+
+func TestSunEvent(t *testing.T) {
+	loc := testNewYork(t)
+	day := time.Date(2024, 5, 31, 12, 0, 0, 0, loc)
+	// from the forecast fixture's astro block
+	cases := []struct {
+		rise bool
+		want time.Time
+	}{
+		{true, time.Date(2024, 5, 31, 5, 35, 0, 0, loc)},
+		{false, time.Date(2024, 5, 31, 20, 23, 0, 0, loc)},
+	}
+	for _, tc := range cases {
+		at, ok := SunEvent(day, loc, testLat, testLon, tc.rise)
+		if !ok {
+			t.Fatalf("expected a sun event for rise %v", tc.rise)
+		}
+		if d := at.Sub(tc.want); d < -2*time.Minute || d > 2*time.Minute {
+			t.Errorf("expected %v, got %v", tc.want, at.In(loc))
+		}
+	}
+
+	// midsummer at the north cape
+	_, ok := SunEvent(time.Date(2024, 6, 21, 12, 0, 0, 0, time.UTC), time.UTC, 71.17, 25.78, true)
+	if ok {
+		t.Error("expected no sunrise during the midnight sun")
+	}
+}
+
+func TestSolarTimepoint(t *testing.T) {
+	loc := testNewYork(t)
+	c := &Config{Latitude: testLat, Longitude: testLon}
+	tp := &WaterTimepoint{Days: []int{0, 1, 2, 3, 4, 5, 6}, Solar: "sunrise", Offset: -30}
+	times := tp.Times(c, time.Date(2024, 5, 31, 0, 0, 0, 0, loc), loc)
+	if len(times) != 1 {
+		t.Fatalf("expected 1 time, got %v", times)
+	}
+	want := time.Date(2024, 5, 31, 5, 5, 0, 0, loc)
+	if d := times[0].Sub(want); d < -2*time.Minute || d > 2*time.Minute || times[0].Second() != 0 {
+		t.Errorf("expected about %v on the minute, got %v", want, times[0].In(loc))
+	}
+
+	// sunset in new york is after utc midnight, it must still land on the local date
+	tp = &WaterTimepoint{Days: []int{5}, Solar: "sunset"}
+	times = tp.Times(c, time.Date(2024, 5, 31, 0, 0, 0, 0, loc), loc)
+	if len(times) != 1 || times[0].In(loc).Day() != 31 {
+		t.Errorf("expected sunset on the 31st, got %v", times)
+	}
+}
+
+func TestCheckSolar(t *testing.T) {
+	loc := testNewYork(t)
+	if loc.String() != time.Local.String() {
+		t.Skip("forecast times are parsed in local time, needs TZ=America/New_York")
+	}
+	f, err := os.ReadFile("./fixtures/forecast.json")
+	if err != nil {
+		t.Fatalf("could not read forecast file: %v", err)
+	}
+	var forecast WeatherForecastResponse
+	err = json.Unmarshal(f, &forecast)
+	if err != nil {
+		t.Fatalf("could not parse forecast file: %v", err)
+	}
+	data := &WeatherData{}
+	data.Sunrise, data.Sunset, err = forecast.Forecast.Days[0].SunTimes()
+	if err != nil {
+		t.Fatalf("could not get forecast sun times: %v", err)
+	}
+
+	c := &Config{Latitude: testLat, Longitude: testLon, SolarCheck: 5}
+	err = CheckSolar(c, data)
+	if err != nil {
+		t.Errorf("expected computed times to match forecast: %v", err)
+	}
+	// latitude and longitude swapped
+	c.Latitude, c.Longitude = testLon, testLat
+	if CheckSolar(c, data) == nil {
+		t.Error("expected error with swapped latitude and longitude")
+	}
+}
+
+func TestForecastSunTimes(t *testing.T) {
+	fd := &ForecastDay{
+		Date:  Date{time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)},
+		Astro: &Astro{Sunrise: "05:35 AM", Sunset: "08:23 PM"},
+	}
+	rise, set, err := fd.SunTimes()
+	if err != nil {
+		t.Fatalf("could not parse sun times: %v", err)
+	}
+	if rise.Hour() != 5 || rise.Minute() != 35 || set.Hour() != 20 || set.Minute() != 23 || set.Day() != 31 {
+		t.Errorf("unexpected sun times %v %v", rise, set)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// state that has to survive restarts, persisted to config.StateFile.
+// the file is also changed by commands run while the system is running, see command.go,
+// so it's reloaded before being read and locked while being changed
+type State struct {
+	path string
+	mu   sync.Mutex
+	StateData
+}
+
+// the part of State kept in the file
+type StateData struct {
+	LastEvaluated time.Time `json:"last_evaluated"` // scheduler has handled every timepoint up to here, see scheduler.go
+
+	// system turned off, e.g. winterized, nothing waters until it's turned back on, see calendar.go
+	Off       bool      `json:"off"`
+	OffReason string    `json:"off_reason"`
+	OffSince  time.Time `json:"off_since"`
+
+	RainDelayUntil time.Time `json:"rain_delay_until"` // no watering until then, cleared once the delay has expired, see raindelay.go
+
+	// runtime reserved on UsageDay, so daily caps survive restarts, see limits.go
+	UsageDay   string         `json:"usage_day"`
+	Usage      map[string]int `json:"usage"` // seconds keyed by valve id
+	UsageTotal int            `json:"usage_total"`
+}
+
+// load state from file, starting empty if the file doesn't exist yet
+func LoadState(path string) (*State, error) {
+	st := &State{path: path}
+	err := st.load()
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// read state from file, caller must hold the lock
+func (st *State) load() error {
+	f, err := os.ReadFile(st.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read state file: %v", err)
+	}
+	var sd StateData
+	err = json.Unmarshal(f, &sd)
+	if err != nil {
+		return fmt.Errorf("could not parse state file: %v", err)
+	}
+	st.StateData = sd
+	return nil
+}
+
+// write state to file, caller must hold the lock
+func (st *State) save() error {
+	b, err := json.Marshal(st.StateData)
+	if err != nil {
+		return fmt.Errorf("could not encode state: %v", err)
+	}
+	tmp := st.path + ".tmp"
+	err = os.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return fmt.Errorf("could not write state file: %v", err)
+	}
+	err = os.Rename(tmp, st.path)
+	if err != nil {
+		return fmt.Errorf("could not write state file: %v", err)
+	}
+	return nil
+}
+
+// reload the state, change it with fn and save it, holding a lock on the file
+// so another process changing it at the same time isn't overwritten
+func (st *State) update(fn func(sd *StateData)) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	lock, err := os.OpenFile(st.path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("could not open state lock file: %v", err)
+	}
+	defer lock.Close()
+	err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return fmt.Errorf("could not lock state file: %v", err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	err = st.load()
+	if err != nil {
+		return err
+	}
+	fn(&st.StateData)
+	return st.save()
+}
+
+// the state as it is in the file now, or as last known if the file can't be read
+func (st *State) current() StateData {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	_ = st.load()
+	return st.StateData
+}
+
+// load the state file, if configured
+func (c *Config) InitState() error {
+	if c.StateFile == "" || c.State != nil {
+		return nil
+	}
+	st, err := LoadState(c.StateFile)
+	if err != nil {
+		return err
+	}
+	c.State = st
+	return nil
+}
+
+func (st *State) Evaluated() time.Time {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.LastEvaluated
+}
+
+func (st *State) SetEvaluated(t time.Time) error {
+	return st.update(func(sd *StateData) {
+		sd.LastEvaluated = t
+	})
+}
+
+// whether the system has been turned off, and why
+func (st *State) IsOff() (bool, string) {
+	sd := st.current()
+	return sd.Off, sd.OffReason
+}
+
+// turn the system off until SetOn is called
+func (st *State) SetOff(reason string) error {
+	return st.update(func(sd *StateData) {
+		if !sd.Off {
+			sd.OffSince = time.Now()
+		}
+		sd.Off = true
+		sd.OffReason = reason
+	})
+}
+
+func (st *State) SetOn() error {
+	return st.update(func(sd *StateData) {
+		sd.Off = false
+		sd.OffReason = ""
+		sd.OffSince = time.Time{}
+	})
+}
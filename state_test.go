@@ -0,0 +1,31 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStatePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	st, err := LoadState(path)
+	if err != nil {
+		t.Fatalf("could not load state: %v", err)
+	}
+	if !st.Evaluated().IsZero() {
+		t.Error("expected empty state from missing file")
+	}
+	at := time.Date(2024, 6, 17, 7, 1, 0, 0, time.UTC)
+	err = st.SetEvaluated(at)
+	if err != nil {
+		t.Fatalf("could not save state: %v", err)
+	}
+
+	st, err = LoadState(path)
+	if err != nil {
+		t.Fatalf("could not reload state: %v", err)
+	}
+	if !st.Evaluated().Equal(at) {
+		t.Errorf("expected %v after reload, got %v", at, st.Evaluated())
+	}
+}
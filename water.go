@@ -1,11 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"slices"
 	"time"
-
-	"github.com/stianeikeland/go-rpio/v4"
 )
 
 // Instructions specifying when and how to water on a given valve
@@ -14,7 +13,29 @@ type WaterTimepoint struct {
 	Hour     int    `json:"hour"`     // hour of water timepoint (0-23)
 	Minute   int    `json:"minute"`   // minute of water timpoint (0-59)
 	Type     string `json:"type"`     // type of water, primary or secondary
-	Duration int    `json:"duration"` // amount of time to water in seconds
+	Duration int    `json:"duration"` // amount of time to water in seconds, or the timeout when watering by volume
+
+	VolumeL float32 `json:"volume_l"` // litres to water instead of a fixed duration, needs a flow meter
+
+	// cycle and soak, overrides the valve's settings when CycleSeconds is set, see CycleSoak
+	CycleSeconds int `json:"cycle_seconds"` // longest single cycle, the duration is split into cycles no longer than this
+	SoakSeconds  int `json:"soak_seconds"`  // least time to wait between cycles so water can soak in
+
+	Missed string `json:"missed"` // when missed while not running or skipped by the clock jumping forward: "skip" (default) logs it, "run" runs it late, "notify" logs and sends a notification
+
+	// day rules checked along with Days, every rule that's set must match, see OnDay.
+	// Days can be left empty when another rule is set
+	EveryDays  int    `json:"every_days"`  // water every N days, counting from Anchor
+	Anchor     string `json:"anchor"`      // date an every_days schedule waters on, as 2006-01-02
+	DateParity string `json:"date_parity"` // "odd" or "even" to only water on odd or even dates
+	MonthDays  []int  `json:"month_days"`  // days of the month (1-31) to water on
+
+	// sun-relative time used instead of hour and minute, see solar.go
+	Solar  string `json:"solar"`  // "sunrise" or "sunset"
+	Offset int    `json:"offset"` // minutes after the sun event, negative for before
+
+	Cron string        `json:"cron"` // optional 5-field cron expression used instead of hour and minute, also limited by days and day rules if set, see cron.go
+	cron *CronSchedule // parsed Cron, see Schedule
 }
 
 // Control specifications for valve
@@ -22,37 +43,191 @@ type Valve struct {
 	ID         string            `json:"id"`         // id of valve, arbitrary, used for logging
 	Name       string            `json:"name"`       // string name of valve, arbitrary, used for logging
 	Pin        int               `json:"pin"`        // gpio pin # that controls the valve, pinctrl convention
+	Driver     string            `json:"driver"`     // optional override of the config level valve driver
+	Chip       string            `json:"chip"`       // gpio chip for the gpiod driver, e.g. gpiochip0
+	Line       int               `json:"line"`       // line offset on chip for the gpiod driver
 	Timepoints []*WaterTimepoint `json:"timepoints"` // list of timepoints that describes the water schedule for the valve
+	Device     ValveDriver       `json:"-"`          // driver that physically opens and closes the valve, set from config
+
+	// runtime safety limits in seconds, see limits.go, 0 means no limit
+	MaxRunDuration  int `json:"max_run_duration"`  // longest single run, overrides the config level limit
+	MaxDailyRuntime int `json:"max_daily_runtime"` // total runtime per day for this valve
+
+	Moisture *MoistureProbe `json:"moisture"` // optional soil moisture probe for the zone, see moisture.go
+
+	// cycle and soak for slow-draining soil or slopes, 0 waters the whole duration at once
+	CycleSeconds int `json:"cycle_seconds"` // longest single cycle
+	SoakSeconds  int `json:"soak_seconds"`  // least time to wait between cycles
+
+	// output wiring, see driver.go
+	Polarity   string `json:"polarity"`    // "active_high" (default), or "active_low" for relay boards that switch on a low output
+	Latching   bool   `json:"latching"`    // latching dc solenoid, opened and closed with pulses instead of a held output
+	OpenPin    int    `json:"open_pin"`    // output pulsed to latch the valve open, a pin, line, expander pin or coil depending on driver
+	ClosePin   int    `json:"close_pin"`   // output pulsed to latch the valve closed
+	PulseWidth int    `json:"pulse_width"` // ms to hold a latching pulse, defaults to 50
+
+	// i2c expander output, for the mcp23017 and pcf8574 drivers, see i2c.go
+	Bus     int `json:"bus"`     // i2c bus number, as in /dev/i2c-N
+	Address int `json:"address"` // 7-bit device address, e.g. 32 for 0x20
+	Port    int `json:"port"`    // expander pin the valve's relay is on
+
+	// modbus relay board output, for the modbus driver, see modbus.go
+	Unit int `json:"unit"` // board's unit id, defaults to 1
+	Coil int `json:"coil"` // coil address of the valve's relay
+
+	Remote *RemoteRelay `json:"remote"` // wi-fi relay, for the http driver, see remote.go
+
+	Seasonal *SeasonalAdjust `json:"seasonal_adjust"` // replaces the config level seasonal adjust, see seasonal.go
 }
 
-// activate valve-connected gpio pin, keep output on for specified duration
-func (v *Valve) Water(c *Config, duration int) error {
-	err := rpio.Open()
-	if err != nil {
-		return fmt.Errorf("could not open gpio memory range: %v", err)
+// cycle and soak seconds for a timepoint, taken from the timepoint if it sets a cycle, otherwise the valve
+func (v *Valve) CycleSoak(tp *WaterTimepoint) (int, int) {
+	if tp != nil && tp.CycleSeconds > 0 {
+		return tp.CycleSeconds, tp.SoakSeconds
 	}
+	return v.CycleSeconds, v.SoakSeconds
+}
 
-	pin := rpio.Pin(v.Pin)
-	pin.Output()
-	pin.High()
+// open valve through its driver, keep it open for specified duration or until ctx is cancelled.
+// the valve is always closed before returning
+func (v *Valve) Water(ctx context.Context, c *Config, duration int) error {
+	return v.waterUntil(ctx, duration, nil)
+}
+
+// open valve for up to duration seconds, closing early once done returns true.
+// done is polled every flowPollInterval, pass nil to run for the full duration
+func (v *Valve) waterUntil(ctx context.Context, duration int, done func() bool) error {
+	if v.Device == nil {
+		return fmt.Errorf("no driver configured for valve %v", v.ID)
+	}
 
-	time.Sleep(time.Second * time.Duration(duration))
-	pin.Low()
+	err := v.Device.Open(v)
+	if err != nil {
+		// try to close anyway, in case the valve opened but reported an error
+		_ = v.Device.Close(v)
+		return fmt.Errorf("could not open valve: %v", err)
+	}
+
+	timer := time.NewTimer(time.Second * time.Duration(duration))
+	defer timer.Stop()
+	var poll <-chan time.Time
+	if done != nil {
+		ticker := time.NewTicker(flowPollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+wait:
+	for {
+		select {
+		case <-timer.C:
+			break wait
+		case <-ctx.Done():
+			break wait
+		case <-poll:
+			if done() {
+				break wait
+			}
+		}
+	}
 
-	err = rpio.Close()
+	err = v.Device.Close(v)
 	if err != nil {
-		return fmt.Errorf("could not close gpio: %v", err)
+		return fmt.Errorf("could not close valve: %v", err)
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("watering cancelled: %v", ctx.Err())
 	}
 
 	return nil
 }
 
+// whether the timepoint waters on the date of t, in t's location
+func (tp *WaterTimepoint) OnDay(t time.Time) bool {
+	rules := false
+	if tp.EveryDays > 0 {
+		rules = true
+		anchor, err := time.Parse("2006-01-02", tp.Anchor)
+		if err != nil {
+			return false
+		}
+		// count calendar days in utc, so DST doesn't shorten or lengthen a day
+		y, m, d := t.Date()
+		days := int(time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Sub(anchor).Hours() / 24)
+		if days%tp.EveryDays != 0 {
+			return false
+		}
+	}
+	if tp.DateParity != "" {
+		rules = true
+		if (t.Day()%2 == 1) != (tp.DateParity == "odd") {
+			return false
+		}
+	}
+	if len(tp.MonthDays) > 0 {
+		rules = true
+		if !slices.Contains(tp.MonthDays, t.Day()) {
+			return false
+		}
+	}
+	if len(tp.Days) == 0 {
+		return rules
+	}
+	return slices.Contains(tp.Days, int(t.Weekday()))
+}
+
+// whether Days or any of the day rules are set
+func (tp *WaterTimepoint) hasDays() bool {
+	return len(tp.Days) > 0 || tp.EveryDays > 0 || tp.DateParity != "" || len(tp.MonthDays) > 0
+}
+
+// parsed cron expression, nil if the timepoint doesn't use one
+func (tp *WaterTimepoint) Schedule() (*CronSchedule, error) {
+	if tp.Cron == "" || tp.cron != nil {
+		return tp.cron, nil
+	}
+	cs, err := ParseCron(tp.Cron)
+	if err != nil {
+		return nil, err
+	}
+	tp.cron = cs
+	return cs, nil
+}
+
+// times the timepoint is due on the date of day in loc, oldest first
+func (tp *WaterTimepoint) Times(c *Config, day time.Time, loc *time.Location) []time.Time {
+	day = day.In(loc)
+	if tp.Cron != "" {
+		cs, err := tp.Schedule()
+		if err != nil {
+			return nil
+		}
+		// days and day rules narrow a cron schedule down further, when any are set
+		if tp.hasDays() && !tp.OnDay(day) {
+			return nil
+		}
+		return cs.Times(day, loc)
+	}
+	if !tp.OnDay(day) {
+		return nil
+	}
+	if tp.Solar != "" {
+		sun, ok := SunEvent(day, loc, c.Latitude, c.Longitude, tp.Solar == "sunrise")
+		if !ok {
+			return nil
+		}
+		at := sun.Add(time.Duration(tp.Offset) * time.Minute).Truncate(time.Minute)
+		return []time.Time{at}
+	}
+	y, m, d := day.Date()
+	return []time.Time{time.Date(y, m, d, tp.Hour, tp.Minute, 0, 0, loc)}
+}
+
 // check if the time is within a watering timepoint
 func (v *Valve) IsWaterTimepoint(c *Config, t time.Time) (bool, *WaterTimepoint) {
 	for _, tp := range v.Timepoints {
 		if (tp.Hour == t.Local().Hour()) &&
 			(tp.Minute == t.Local().Minute()) &&
-			slices.Contains(tp.Days, int(t.Local().Weekday())) {
+			tp.OnDay(t.Local()) {
 			return true, tp
 		}
 	}
@@ -25,3 +25,37 @@ func TestIsWaterTimepoint(t *testing.T) {
 		t.Errorf("expected time point to be true, returned false")
 	}
 }
+
+func TestTimepointDayRules(t *testing.T) {
+	// monday 17 june 2024
+	day := func(d int) time.Time {
+		return time.Date(2024, 6, d, 7, 0, 0, 0, time.Local)
+	}
+	cases := []struct {
+		name string
+		tp   *WaterTimepoint
+		days map[int]bool
+	}{
+		{"every 3 days", &WaterTimepoint{EveryDays: 3, Anchor: "2024-06-01"}, map[int]bool{16: true, 17: false, 18: false, 19: true}},
+		{"anchor in the future", &WaterTimepoint{EveryDays: 2, Anchor: "2024-07-01"}, map[int]bool{17: true, 18: false}},
+		{"odd dates", &WaterTimepoint{DateParity: "odd"}, map[int]bool{17: true, 18: false}},
+		{"even dates", &WaterTimepoint{DateParity: "even"}, map[int]bool{17: false, 18: true}},
+		{"month days", &WaterTimepoint{MonthDays: []int{1, 15, 18}}, map[int]bool{15: true, 17: false, 18: true}},
+		// rules combine with days of week
+		{"even weekdays", &WaterTimepoint{Days: []int{1, 2, 3, 4, 5}, DateParity: "even"}, map[int]bool{16: false, 18: true, 19: false, 22: false}},
+		{"no days", &WaterTimepoint{}, map[int]bool{17: false}},
+	}
+	for _, tc := range cases {
+		for d, want := range tc.days {
+			if tc.tp.OnDay(day(d)) != want {
+				t.Errorf("%v: expected %v on june %v", tc.name, want, d)
+			}
+		}
+	}
+
+	v := &Valve{Timepoints: []*WaterTimepoint{&WaterTimepoint{Hour: 7, DateParity: "odd"}}}
+	is, _ := v.IsWaterTimepoint(&Config{}, day(17))
+	if !is {
+		t.Error("expected odd date timepoint to match")
+	}
+}
@@ -65,10 +65,17 @@ func (d *Date) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// sun and moon times for a forecast day, as "05:35 AM" in local time
+type Astro struct {
+	Sunrise string `json:"sunrise"`
+	Sunset  string `json:"sunset"`
+}
+
 // individual day within forecast response
 type ForecastDay struct {
 	Date  Date           `json:"date"`
 	Hours []*WeatherHour `json:"hour"`
+	Astro *Astro         `json:"astro"`
 }
 
 // aggregate of forecast days
@@ -86,6 +93,10 @@ type WeatherData struct {
 	Current      *CurrentWeather
 	PastPrecip   float32 // number of mm in lookback period
 	FuturePrecip float32 // number of mm in lookahead period
+
+	// today's sun times from the forecast, for checking computed ones, see solar.go
+	Sunrise time.Time
+	Sunset  time.Time
 }
 
 // Parse hourly data from weather api responses to determine past and projected precipitation
@@ -152,14 +163,14 @@ func GetWeatherHistory(c *Config, now time.Time) (*WeatherForecastResponse, erro
 	return &history, nil
 }
 
-// get amount of precipitation for lookback + lookahead interval, along with current weather
+// get amount of precipitation for lookback + lookahead interval, along with current weather.
+// when the weather api is off or fails, a rain gauge still gives the lookback precipitation
 func GetWeatherTimeline(c *Config) (*WeatherData, error) {
-	if c.UseWeather {
-		now := time.Now()
-
+	now := time.Now()
+	if c.WeatherOn() {
 		weather, err := GetWeatherForecast(c)
 		if err != nil {
-			return nil, fmt.Errorf("could not get weather forecast: %v", err)
+			return c.GaugeWeather(now), fmt.Errorf("could not get weather forecast: %v", err)
 		}
 
 		fc := weather.CurrentWeather
@@ -172,11 +183,13 @@ func GetWeatherTimeline(c *Config) (*WeatherData, error) {
 			}
 		}
 
-		// Decide whether we need weather history, i.e. whether the lookback takes us into yesterday
-		if now.Add(time.Duration(-c.RainLookback)*time.Hour).Day() != now.Day() {
+		// Decide whether we need weather history, i.e. whether the lookback takes us into yesterday,
+		// and that a rain gauge isn't standing in for it
+		replaced := c.RainGauge != nil && (c.RainGauge.Mode == "" || c.RainGauge.Mode == "replace")
+		if !replaced && now.Add(time.Duration(-c.RainLookback)*time.Hour).Day() != now.Day() {
 			history, err := GetWeatherHistory(c, now)
 			if err != nil {
-				return nil, fmt.Errorf("could not get weather history: %v", err)
+				return c.GaugeWeather(now), fmt.Errorf("could not get weather history: %v", err)
 			}
 
 			historyTps := make([]*WeatherHour, 0)
@@ -189,18 +202,33 @@ func GetWeatherTimeline(c *Config) (*WeatherData, error) {
 
 		data := ParseWeatherTimeline(c, now, timepoints)
 		data.Current = fc
+		if len(weather.Forecast.Days) > 0 {
+			// astro data is only used to check computed sun times, so it's fine without it
+			data.Sunrise, data.Sunset, _ = weather.Forecast.Days[0].SunTimes()
+		}
+		if c.RainGauge != nil {
+			c.RainGauge.Apply(c, now, data)
+		}
 
 		return data, nil
 	}
-	return nil, nil
+	return c.GaugeWeather(now), nil
 }
 
 func (cw *CurrentWeather) IsHot(c *Config) bool {
+	// no current weather when only the rain gauge is available
+	if cw == nil {
+		return false
+	}
 	return cw.Temp > c.HotThreshold
 }
 
 // Determine whether to water during a primary timepoint based on weather history/forecast
 func ShouldWaterPrimary(c *Config, data *WeatherData) bool {
+	// return false if it's raining right now
+	if c.RainSensor.Raining() {
+		return false
+	}
 	// return false if it's been/will be rainy
 	if data != nil {
 		if (data.PastPrecip + data.FuturePrecip) >= c.RainThreshold {
@@ -213,6 +241,10 @@ func ShouldWaterPrimary(c *Config, data *WeatherData) bool {
 // Determine whether to water during a primary timepoint based on weather history/forecast
 // and current conditions
 func ShouldWaterSecondary(c *Config, data *WeatherData) bool {
+	// return false if it's raining right now
+	if c.RainSensor.Raining() {
+		return false
+	}
 	// return false if it's been/will be rainy
 	if data != nil {
 		if (data.PastPrecip + data.FuturePrecip) >= c.RainThreshold {
@@ -225,11 +257,33 @@ func ShouldWaterSecondary(c *Config, data *WeatherData) bool {
 	return false
 }
 
-func ShouldWater(c *Config, data *WeatherData, tp *WaterTimepoint) bool {
-	if tp.Type == "primary" && ShouldWaterPrimary(c, data) {
+// Decide whether to water at a timepoint from weather and local sensor readings.
+// Soil moisture overrides the weather: wet soil skips a primary timepoint,
+// and dry soil fires a secondary one unless it's been/will be rainy
+func ShouldWater(c *Config, data *WeatherData, tp *WaterTimepoint, sd *SensorData) bool {
+	if tp.Type == "primary" && !sd.TooWet() && ShouldWaterPrimary(c, data) {
+		return true
+	} else if tp.Type == "secondary" && sd.TooDry() && ShouldWaterPrimary(c, data) {
 		return true
 	} else if tp.Type == "secondary" && ShouldWaterSecondary(c, data) {
 		return true
 	}
 	return false
 }
+
+// Explain why ShouldWater decided against watering, for the event log
+func SkipReason(c *Config, data *WeatherData, tp *WaterTimepoint, sd *SensorData) string {
+	if c.RainSensor.Raining() {
+		return "rain sensor tripped"
+	}
+	if data != nil && (data.PastPrecip+data.FuturePrecip) >= c.RainThreshold {
+		return fmt.Sprintf("%vmm of rain at or over %vmm threshold", data.PastPrecip+data.FuturePrecip, c.RainThreshold)
+	}
+	if tp.Type == "primary" && sd.TooWet() {
+		return fmt.Sprintf("soil moisture %.0f%% above %v%%", *sd.Moisture, sd.Probe.SkipAbove)
+	}
+	if tp.Type == "secondary" {
+		return "not hot or dry enough for secondary watering"
+	}
+	return fmt.Sprintf("unknown timepoint type %q", tp.Type)
+}